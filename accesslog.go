@@ -0,0 +1,246 @@
+// Copyright © 2013 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package godspeed
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Format of access log lines
+type LogFormat int
+
+const (
+	// Apache Common Log Format
+	CommonLog LogFormat = iota
+	// Apache Combined Log Format: Common plus referer and user agent
+	CombinedLog
+	// One JSON object per line, through log/slog
+	JSONLog
+)
+
+// Settings for AccessLog
+type AccessLogOptions struct {
+	Format LogFormat
+	// Where log lines go. Nil means os.Stderr.
+	Output io.Writer
+	// Number of log lines that can be waiting to be written before requests
+	// have to wait for the writer to catch up. Zero means 1024.
+	Buffer int
+}
+
+// Writes lines in the background, so slow output does not hold up requests
+// unless the backlog is full. Lines are written in batches: the output is only
+// flushed once nothing is waiting. A batch that fails to flush is reported and
+// dropped; later batches are still tried.
+type asyncWriter struct {
+	mu     sync.RWMutex
+	closed bool
+	lines  chan []byte
+	done   chan struct{}
+	// Error flushing the last batch, set before done is closed
+	err error
+}
+
+var errAccessLogClosed = errors.New("access log closed")
+
+func newAsyncWriter(w io.Writer, n int) *asyncWriter {
+	a := &asyncWriter{
+		lines: make(chan []byte, n),
+		done:  make(chan struct{}),
+	}
+	go a.run(w)
+	return a
+}
+
+func (a *asyncWriter) run(w io.Writer) {
+	defer close(a.done)
+	bw := bufio.NewWriter(w)
+	for line := range a.lines {
+		bw.Write(line)
+		if len(a.lines) > 0 {
+			continue
+		}
+		a.err = bw.Flush()
+		if a.err != nil {
+			reportError(nil, fmt.Errorf("access log: %w", a.err))
+			// A bufio.Writer keeps failing after its first error
+			bw.Reset(w)
+		}
+	}
+}
+
+func (a *asyncWriter) Write(line []byte) (int, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return 0, errAccessLogClosed
+	}
+	// Caller may reuse the buffer
+	a.lines <- append([]byte(nil), line...)
+	return len(line), nil
+}
+
+// Write out the waiting lines and stop. Later lines are dropped.
+func (a *asyncWriter) Close() error {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.lines)
+	}
+	a.mu.Unlock()
+	<-a.done
+	return a.err
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func requestURI(r *http.Request) string {
+	if r.RequestURI != "" {
+		return r.RequestURI
+	}
+	return r.URL.RequestURI()
+}
+
+// "-" for missing values, like Apache
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// Escape bytes that could break up a log line or field, Apache-style
+func escapeLogField(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || c == '"' || c == '\\' {
+			fmt.Fprintf(&b, "\\x%02x", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func commonLogLine(r *http.Request, s *Stats, combined bool) []byte {
+	user, _, _ := r.BasicAuth()
+	size := "-"
+	if s.SentBytes > 0 {
+		size = strconv.FormatInt(s.SentBytes, 10)
+	}
+	line := fmt.Sprintf("%s - %s [%s] %s %d %s",
+		remoteHost(r),
+		orDash(escapeLogField(user)),
+		s.Start.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(r.Method+" "+requestURI(r)+" "+r.Proto),
+		s.Status,
+		size)
+	if combined {
+		line += " " + strconv.Quote(orDash(r.Referer())) +
+			" " + strconv.Quote(orDash(r.UserAgent()))
+	}
+	return []byte(line + "\n")
+}
+
+func logJSON(logger *slog.Logger, r *http.Request, head http.Header, s *Stats) {
+	rec := slog.NewRecord(s.Start, slog.LevelInfo, "request", 0)
+	rec.AddAttrs(
+		slog.String("remote", remoteHost(r)),
+		slog.String("method", r.Method),
+		slog.String("uri", requestURI(r)),
+		slog.String("proto", r.Proto),
+		slog.Int("status", s.Status),
+		slog.Int64("bytes", s.SentBytes),
+		slog.Int64("body_bytes", s.BodyBytes),
+		slog.Duration("duration", s.Duration),
+		slog.Duration("ttfb", s.FirstByte),
+		slog.String("cache", head.Get("X-Cache")),
+		slog.String("encoding", head.Get("Content-Encoding")),
+		slog.String("referer", r.Referer()),
+		slog.String("user_agent", r.UserAgent()),
+	)
+	logger.Handler().Handle(context.Background(), rec)
+}
+
+// Handler that logs every request, from AccessLog
+type AccessLogger struct {
+	h      http.Handler
+	format LogFormat
+	aw     *asyncWriter
+	logger *slog.Logger
+}
+
+// Log every request in the chosen format. Lines are written asynchronously by
+// a goroutine that runs until the logger is closed. Wrap the whole stack in
+// this, so the logged sizes are those actually sent to the client.
+func AccessLog(h http.Handler, opts AccessLogOptions) *AccessLogger {
+	out := opts.Output
+	if out == nil {
+		out = os.Stderr
+	}
+	n := opts.Buffer
+	if n == 0 {
+		n = 1024
+	}
+	aw := newAsyncWriter(out, n)
+	return &AccessLogger{
+		h:      h,
+		format: opts.Format,
+		aw:     aw,
+		logger: slog.New(slog.NewJSONHandler(aw, nil)),
+	}
+}
+
+func (l *AccessLogger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rw := WrapResponse(w, r, nil)
+	l.h.ServeHTTP(rw, r)
+	rw.Close()
+	s := ResponseStats(rw)
+	if l.format == JSONLog {
+		logJSON(l.logger, r, rw.Header(), s)
+	} else {
+		l.aw.Write(commonLogLine(r, s, l.format == CombinedLog))
+	}
+}
+
+// Write out the lines still waiting and stop the writer goroutine. Call this
+// once the server has shut down; requests logged after it are dropped.
+func (l *AccessLogger) Close() error {
+	return l.aw.Close()
+}
@@ -0,0 +1,155 @@
+// Copyright © 2013 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package godspeed
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Passes every write on to a channel
+type chanWriter chan string
+
+func (c chanWriter) Write(data []byte) (int, error) {
+	c <- string(data)
+	return len(data), nil
+}
+
+func accessLogLine(t *testing.T, format LogFormat, h http.Handler) string {
+	lines := make(chanWriter, 1)
+	h = AccessLog(h, AccessLogOptions{Format: format, Output: lines})
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/test.txt?x=1", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("Referer", "http://example.com/")
+	r.Header.Set("User-Agent", "test")
+	r.Header.Set("Accept-Encoding", "gzip")
+	h.ServeHTTP(rec, r)
+	select {
+	case line := <-lines:
+		return line
+	case <-time.After(5 * time.Second):
+		t.Fatal("No access log line written")
+	}
+	return ""
+}
+
+func TestAccessLogCommon(t *testing.T) {
+	line := accessLogLine(t, CommonLog, testHandlerSimple)
+	re := regexp.MustCompile(`^192\.0\.2\.1 - - \[[^]]+\] "GET /test\.txt\?x=1 HTTP/1\.1" 200 4\n$`)
+	if !re.MatchString(line) {
+		t.Errorf("Unexpected common log line: %q", line)
+	}
+	line = accessLogLine(t, CombinedLog, testHandlerSimple)
+	if !regexp.MustCompile(` 200 4 "http://example\.com/" "test"\n$`).MatchString(line) {
+		t.Errorf("Unexpected combined log line: %q", line)
+	}
+}
+
+// Users from basic auth can not forge log lines
+func TestAccessLogUser(t *testing.T) {
+	lines := make(chanWriter, 1)
+	h := AccessLog(testHandlerSimple, AccessLogOptions{Output: lines})
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("x - [01/Jan/2000:00:00:00 +0000] \"GET /admin HTTP/1.1\" 200 1\n1.2.3.4 - bob", "pw")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	line := <-lines
+	if strings.Count(line, "\n") != 1 || strings.Contains(line, "GET /admin") {
+		t.Errorf("Forged log line: %q", line)
+	}
+	if !strings.Contains(line, ` x\x20-\x20[01/Jan/2000`) {
+		t.Errorf("User not escaped: %q", line)
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Cache", "Hit")
+		fmt.Fprint(w, "test")
+	})
+	line := accessLogLine(t, JSONLog, Compress(Mimetype(h)))
+	var entry struct {
+		Status    int
+		Bytes     int64
+		BodyBytes int64 `json:"body_bytes"`
+		Cache     string
+		Encoding  string
+	}
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		t.Fatalf("Invalid JSON log line %q: %v", line, err)
+	}
+	if entry.Status != 200 || entry.BodyBytes != 4 || entry.Bytes <= 4 ||
+		entry.Cache != "Hit" || entry.Encoding != "gzip" {
+		t.Errorf("Unexpected JSON log line: %q", line)
+	}
+}
+
+// Fails its first write
+type flakyWriter struct {
+	failed chan struct{}
+	buf    bytes.Buffer
+}
+
+func (f *flakyWriter) Write(data []byte) (int, error) {
+	select {
+	case <-f.failed:
+		return f.buf.Write(data)
+	default:
+		close(f.failed)
+		return 0, errors.New("disk full")
+	}
+}
+
+// A failed flush loses only its own lines, and Close writes out the rest
+func TestAccessLogClose(t *testing.T) {
+	defer func(eh ErrorHandler) { DefaultErrorHandler = eh }(DefaultErrorHandler)
+	var errs []error
+	DefaultErrorHandler = ErrorHandlerFunc(func(r *http.Request, err error) {
+		errs = append(errs, err)
+	})
+	out := &flakyWriter{failed: make(chan struct{})}
+	l := AccessLog(testHandlerSimple, AccessLogOptions{Output: out})
+	r, _ := http.NewRequest("GET", "/first", nil)
+	l.ServeHTTP(httptest.NewRecorder(), r)
+	<-out.failed
+	r, _ = http.NewRequest("GET", "/second", nil)
+	l.ServeHTTP(httptest.NewRecorder(), r)
+	if err := l.Close(); err != nil {
+		t.Errorf("Unexpected error closing: %v", err)
+	}
+	if line := out.buf.String(); strings.Count(line, "\n") != 1 || !strings.Contains(line, "GET /second") {
+		t.Errorf("Unexpected log after failed write: %q", line)
+	}
+	if len(errs) != 1 {
+		t.Errorf("Reported %d errors, expected: 1", len(errs))
+	}
+	// Closed: dropped, not blocked or panicking
+	l.ServeHTTP(httptest.NewRecorder(), r)
+	l.Close()
+}
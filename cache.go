@@ -21,8 +21,8 @@
 package godspeed
 
 import (
+	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"strings"
@@ -50,7 +50,7 @@ func (e diskEntry) OnPurge(why lrucache.PurgeReason) {
 	err := os.Remove(e.path)
 	if err != nil {
 		// Unexpected and seemingly harmless so I don't really care
-		log.Print("Failed to remove ", e.path, " from godspeed cache: ", err)
+		reportError(nil, fmt.Errorf("failed to remove %q from cache: %w", e.path, err))
 	}
 }
 
@@ -65,6 +65,20 @@ func cachepath(c *cacheWrapper, r *http.Request) string {
 	return c.Basedir + host + "/" + r.URL.Path
 }
 
+// Whether a response varies on nothing but Accept-Encoding. Encoding is not a
+// problem as long as Cache sits inside Compress.
+func cacheableVary(head http.Header) bool {
+	for _, v := range head.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			f = strings.TrimSpace(f)
+			if f != "" && !strings.EqualFold(f, "Accept-Encoding") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // Uses X-Cache header to determine cacheability (POC)
 // Obvious TODO: real HTTP/1.1 conforming caching
 func (c *cacheWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -83,7 +97,8 @@ func (c *cacheWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var cachef *os.File
-	f := func(w http.ResponseWriter) io.Writer {
+	f := func(ri ResponseInfo) io.Writer {
+		w := ri.ResponseWriter
 		head := w.Header()
 		cached := "0"
 		defer func() {
@@ -92,38 +107,45 @@ func (c *cacheWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if head.Get("X-Cache") == "" {
 			return w
 		}
+		if !cacheableVary(head) {
+			// Only the body is cached, so this would serve one client's
+			// variant to all
+			return w
+		}
 		head.Set("X-Cache", "Miss")
 		cachedir := dirname(path)
 		err := os.MkdirAll(cachedir, 0700)
 		if err != nil {
 			// Probrem? Just continue as if nothing happened
-			log.Printf("Could not create cache file dir %q: %s",
-				cachedir, err.Error())
+			reportError(r, fmt.Errorf("could not create cache file dir %q: %w",
+				cachedir, err))
 			return w
 		}
 		cachef, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
 		if err != nil {
-			log.Printf("Could not open cache file %q for writing: %s",
-				path, err.Error())
+			reportError(r, fmt.Errorf("could not open cache file %q for writing: %w",
+				path, err))
 			return w
 		}
 		cached = "1"
 		return io.MultiWriter(cachef, w)
 	}
-	c.wrapped.ServeHTTP(wrapBody(w, f), r)
+	bw := WrapResponse(w, r, f)
+	c.wrapped.ServeHTTP(bw, r)
+	bw.Close()
 	if cachef == nil {
 		return
 	}
 	stat, err := cachef.Stat()
 	if err != nil {
-		log.Printf("Failed to obtain stat info for %q: %v", path, err)
+		reportError(r, fmt.Errorf("failed to obtain stat info for %q: %w", path, err))
 		cachef.Close()
 		os.Remove(path)
 		return
 	}
 	err = cachef.Close()
 	if err != nil {
-		log.Printf("Could not save cache file %q: %v", path, err)
+		reportError(r, fmt.Errorf("could not save cache file %q: %w", path, err))
 		// No problem
 		return
 	}
@@ -154,6 +176,9 @@ func mustmkdtemp(tmpl string) string {
 //
 // - Non-standard upstream "X-Cache" header is used to determine cacheability
 //
+// - Responses that vary on anything but Accept-Encoding (e.g. CORS responses,
+// which vary on Origin) are not cached at all
+//
 // - Cache hits are served as raw files, introducing some illegal headers
 //
 // - and probably more...
@@ -78,3 +78,17 @@ func TestCache(t *testing.T) {
 	// Clean up cache directory
 	os.RemoveAll(basedir)
 }
+
+// Responses for one origin must not be served to another
+func TestCacheVary(t *testing.T) {
+	h := Cache(CORS(testHandlerCache, CORSOptions{AllowedOrigins: []string{"*"}}))
+	basedir := h.(*cacheWrapper).Basedir
+	defer os.RemoveAll(basedir)
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/test.txt", nil)
+	h.ServeHTTP(rec, r)
+	assert200(t, r, rec)
+	if _, err := os.Stat(basedir + "localhost/test.txt"); err == nil {
+		t.Errorf("Response with Vary: Origin cached")
+	}
+}
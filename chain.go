@@ -0,0 +1,125 @@
+// Copyright © 2013 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package godspeed
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+)
+
+// A layer around a handler, like Compress
+type Middleware func(http.Handler) http.Handler
+
+// Middleware to wrap a handler in, outermost first
+type Stack []Middleware
+
+// Where the wrappers of this package belong in a Stack, outermost first:
+//
+// - Default headers apply to every response, including those served from
+// cache
+//
+// - Ranges apply to the encoded body, so Ranges goes outside Compress and
+// leaves compressed responses alone
+//
+// - Cache hits are plain files, so Cache stays inside Compress
+//
+// - ETag hashes the body as the handler wrote it, and Compress weakens the
+// result when it encodes
+//
+// - Compress decides by Content-Type, so Mimetype has to go inside it
+var middlewareOrder = []Middleware{
+	Decompress,
+	SecureDefaults,
+	XFrameOptions,
+	XContentTypeOptions,
+	XXSSProtection,
+	Ranges,
+	Compress,
+	ETag,
+	Cache,
+	Mimetype,
+}
+
+// Position of m in middlewareOrder, -1 if m is not one of ours. Functions can
+// not be compared in Go, but their code pointers can.
+func middlewareRank(m Middleware) int {
+	p := reflect.ValueOf(m).Pointer()
+	for i, known := range middlewareOrder {
+		if reflect.ValueOf(known).Pointer() == p {
+			return i
+		}
+	}
+	return -1
+}
+
+// Combine middleware into a Stack. The wrappers from this package are put in
+// the right order among themselves, so Chain(Mimetype, Compress) is the same
+// as Chain(Compress, Mimetype): Mimetype has to run first for Compress to know
+// the content type. Other middleware (including closures around the
+// *WithOptions variants) keeps its position, outermost first.
+func Chain(mws ...Middleware) Stack {
+	s := append(Stack(nil), mws...)
+	var slots []int
+	var known []Middleware
+	for i, m := range s {
+		if middlewareRank(m) != -1 {
+			slots = append(slots, i)
+			known = append(known, m)
+		}
+	}
+	sort.SliceStable(known, func(i, j int) bool {
+		return middlewareRank(known[i]) < middlewareRank(known[j])
+	})
+	for i, slot := range slots {
+		s[slot] = known[i]
+	}
+	return s
+}
+
+// New Stack with more middleware, ordered like Chain does
+func (s Stack) Append(mws ...Middleware) Stack {
+	return Chain(append(append(Stack(nil), s...), mws...)...)
+}
+
+// Wrap a handler in all middleware of the stack. A nil handler means
+// http.DefaultServeMux.
+func (s Stack) Then(h http.Handler) http.Handler {
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	for i := len(s) - 1; i >= 0; i-- {
+		h = s[i](h)
+	}
+	return h
+}
+
+// Same as Then, for functions
+func (s Stack) ThenFunc(f func(http.ResponseWriter, *http.Request)) http.Handler {
+	return s.Then(http.HandlerFunc(f))
+}
+
+// Sensible stack for serving a web site: compression of textual responses,
+// content types guessed from the path and the security headers of
+// DefaultPolicy.
+func Default() Stack {
+	return Chain(SecureDefaults, Compress, Mimetype)
+}
@@ -0,0 +1,76 @@
+// Copyright © 2013 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package godspeed
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func sameMiddleware(a, b Middleware) bool {
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
+
+func TestChainOrder(t *testing.T) {
+	custom := Middleware(func(h http.Handler) http.Handler { return h })
+	s := Chain(Mimetype, custom, Compress, XFrameOptions)
+	expected := Stack{XFrameOptions, custom, Compress, Mimetype}
+	if len(s) != len(expected) {
+		t.Fatalf("Chain returned %d layers, expected: %d", len(s), len(expected))
+	}
+	for i := range s {
+		if !sameMiddleware(s[i], expected[i]) {
+			t.Errorf("Unexpected middleware at position %d", i)
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/test.txt", nil)
+	r.Header.Add("Accept-Encoding", "gzip")
+	// Wrong order on purpose
+	Chain(Mimetype, Compress).Then(testHandlerSimple).ServeHTTP(rec, r)
+	assert200(t, r, rec)
+	testContentType(t, r, rec, "text/plain; charset=utf-8")
+	if enc := rec.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Errorf("Unexpected Content-Encoding: %q, expected: gzip", enc)
+	}
+	if body := decode(t, rec); body != "test" {
+		t.Errorf("Unexpected response decompressed: %q, expected: 'test'", body)
+	}
+}
+
+func TestDefault(t *testing.T) {
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/test.txt", nil)
+	r.Header.Add("Accept-Encoding", "gzip")
+	Default().Then(testHandlerSimple).ServeHTTP(rec, r)
+	assert200(t, r, rec)
+	if opt := rec.Header().Get("X-Frame-Options"); opt != "SAMEORIGIN" {
+		t.Errorf("Unexpected X-Frame-Options value: %q, expected: SAMEORIGIN", opt)
+	}
+	if body := decode(t, rec); body != "test" {
+		t.Errorf("Unexpected response decompressed: %q, expected: 'test'", body)
+	}
+}
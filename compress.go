@@ -23,62 +23,308 @@ package godspeed
 import (
 	"compress/gzip"
 	"compress/zlib"
+	"context"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 )
 
-var compressableTypePrefixes = [...]string{
+// Content types compressed by Compress. An entry ending in a slash matches any
+// type with that prefix, an entry starting with a plus matches that structured
+// syntax suffix (RFC 6839) and anything else must match the media type exactly.
+// Parameters like charset are ignored when matching.
+var DefaultCompressTypes = []string{
 	"text/",
+	"+json",
+	"+xml",
 	"application/json",
-	"application/xml+xhtml",
+	"application/xml",
 	"application/javascript",
+	"application/wasm",
+	"image/svg+xml",
 }
 
-func compressable(ctype string) bool {
-	for _, t := range compressableTypePrefixes {
-		if strings.HasPrefix(ctype, t) {
+// Content types not compressed by Compress. Event streams are left alone
+// because intermediaries tend to hold compressed data back until enough of it
+// has accumulated, which defeats the point of streaming events.
+var DefaultCompressExcludeTypes = []string{
+	"text/event-stream",
+}
+
+// Tunables for CompressWithOptions. The zero value behaves like Compress.
+type CompressOptions struct {
+	// Compression level as used by compress/gzip and compress/zlib. Zero means
+	// gzip.DefaultCompression.
+	Level int
+	// Bodies shorter than this many bytes are sent uncompressed: the gzip
+	// header and trailer alone would make them bigger. Up to MinSize bytes of
+	// every compressable response are buffered to make that decision.
+	MinSize int
+	// Content types to compress, in the format of DefaultCompressTypes. Nil
+	// means DefaultCompressTypes.
+	Types []string
+	// Content types never to compress, even when they match Types. Nil means
+	// DefaultCompressExcludeTypes.
+	ExcludeTypes []string
+	// Allocate a new encoder for every response, for benchmarks
+	unpooled bool
+}
+
+// Content codings Compress can produce, in order of preference
+var compressCodings = []string{"gzip", "deflate"}
+
+// Pick the content coding from supported (in order of server preference) that
+// the client likes best according to its Accept-Encoding header. Returns ""
+// if none of them are acceptable.
+func negotiateEncoding(accept string, supported []string) string {
+	qs := map[string]float64{}
+	for _, c := range strings.Split(accept, ",") {
+		c, params, _ := strings.Cut(c, ";")
+		c = strings.ToLower(strings.TrimSpace(c))
+		if c == "" {
+			continue
+		}
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(p, "=")
+			if strings.TrimSpace(k) != "q" {
+				continue
+			}
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				q = f
+			}
+		}
+		qs[c] = q
+	}
+	best := ""
+	bestq := 0.0
+	for _, c := range supported {
+		q, ok := qs[c]
+		if !ok {
+			q = qs["*"]
+		}
+		if q > bestq {
+			best, bestq = c, q
+		}
+	}
+	return best
+}
+
+// Strip parameters and normalize case
+func mediatype(ctype string) string {
+	if i := strings.IndexByte(ctype, ';'); i != -1 {
+		ctype = ctype[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(ctype))
+}
+
+func matchType(mtype string, patterns []string) bool {
+	for _, p := range patterns {
+		switch {
+		case strings.HasSuffix(p, "/"):
+			if strings.HasPrefix(mtype, p) {
+				return true
+			}
+		case strings.HasPrefix(p, "+"):
+			if strings.HasSuffix(mtype, p) {
+				return true
+			}
+		case mtype == p:
 			return true
 		}
 	}
 	return false
 }
 
-// Compress response if possible
+func (o *CompressOptions) compressable(ctype string) bool {
+	mtype := mediatype(ctype)
+	if mtype == "" || matchType(mtype, o.ExcludeTypes) {
+		return false
+	}
+	return matchType(mtype, o.Types)
+}
+
+// Content coding Compress would pick for a response with these headers, size
+// aside. "" if it leaves the response alone.
+func (o *CompressOptions) coding(r *http.Request, head http.Header) string {
+	if !o.compressable(head.Get("Content-Type")) || head.Get("Content-Encoding") != "" {
+		return ""
+	}
+	return negotiateEncoding(r.Header.Get("Accept-Encoding"), compressCodings)
+}
+
+// An encoded body is not byte-for-byte identical to what the handler produced
+func weakenETag(head http.Header) {
+	if etag := head.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		head.Set("ETag", "W/"+etag)
+	}
+}
+
+type compressKey struct{}
+
+// Weaken a strong ETag if a Compress wrapper around the handler of r may
+// encode a response with these headers. Handlers that answer conditional
+// requests themselves call this before checking them: a 304 has no
+// Content-Type to go by once it reaches Compress.
+func weakenForCompress(r *http.Request, head http.Header) {
+	if o, ok := r.Context().Value(compressKey{}).(*CompressOptions); ok && o.coding(r, head) != "" {
+		weakenETag(head)
+	}
+}
+
+// The part of gzip.Writer and zlib.Writer needed to recycle them
+type resetWriter interface {
+	io.WriteCloser
+	Reset(io.Writer)
+	Flush() error
+}
+
+type encoderKey struct {
+	coding string
+	level  int
+}
+
+// Encoders keep hundreds of KB of state, which is worth reusing between
+// responses. One *sync.Pool per encoderKey.
+var encoderPools sync.Map
+
+func encoderPool(coding string, level int) *sync.Pool {
+	key := encoderKey{coding, level}
+	if p, ok := encoderPools.Load(key); ok {
+		return p.(*sync.Pool)
+	}
+	p, _ := encoderPools.LoadOrStore(key, &sync.Pool{New: func() any {
+		var wr resetWriter
+		// Level has been validated
+		switch coding {
+		case "deflate":
+			wr, _ = zlib.NewWriterLevel(io.Discard, level)
+		case "gzip":
+			wr, _ = gzip.NewWriterLevel(io.Discard, level)
+		}
+		return wr
+	}})
+	return p.(*sync.Pool)
+}
+
+// Encoder borrowed from a pool. Close returns it.
+type pooledEncoder struct {
+	resetWriter
+	pool *sync.Pool
+}
+
+func (e *pooledEncoder) Close() error {
+	if e.resetWriter == nil {
+		return nil
+	}
+	err := e.resetWriter.Close()
+	// Do not hold on to the response writer
+	e.Reset(io.Discard)
+	e.pool.Put(e.resetWriter)
+	e.resetWriter = nil
+	return err
+}
+
+func (o *CompressOptions) encoder(coding string, w io.Writer) io.WriteCloser {
+	pool := encoderPool(coding, o.Level)
+	if o.unpooled {
+		// Throwaway pool: Get always allocates
+		pool = &sync.Pool{New: pool.New}
+	}
+	wr := pool.Get().(resetWriter)
+	wr.Reset(w)
+	return &pooledEncoder{resetWriter: wr, pool: pool}
+}
+
+// Compress response if possible. Responses are marked as varying on
+// Accept-Encoding. Encoded responses lose their Content-Length. Strong ETags
+// are weakened whenever the response might be encoded, whatever its size, so
+// the 200 and 304 for a resource carry the same validator.
+// Responses without a body (1xx, 204, 304) are never encoded, while those to
+// HEAD requests get the same headers as the equivalent GET.
 func Compress(h http.Handler) http.Handler {
+	return CompressWithOptions(h, CompressOptions{})
+}
+
+// Like Compress, with explicit settings. Panics if the compression level is
+// invalid.
+func CompressWithOptions(h http.Handler, opts CompressOptions) http.Handler {
+	if opts.Level == 0 {
+		opts.Level = gzip.DefaultCompression
+	}
+	if opts.Level < gzip.HuffmanOnly || opts.Level > gzip.BestCompression {
+		panic("godspeed: invalid compression level")
+	}
+	if opts.Types == nil {
+		opts.Types = DefaultCompressTypes
+	}
+	if opts.ExcludeTypes == nil {
+		opts.ExcludeTypes = DefaultCompressExcludeTypes
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var closer io.Closer
-		f := func(w http.ResponseWriter) io.Writer {
+		r = r.WithContext(context.WithValue(r.Context(), compressKey{}, &opts))
+		f := func(ri ResponseInfo) io.Writer {
+			w := ri.ResponseWriter
 			head := w.Header()
-			if !compressable(head.Get("Content-Type")) {
+			// Even an uncompressed response depends on Accept-Encoding
+			addVary(head, "Accept-Encoding")
+			c := opts.coding(r, head)
+			if c != "" {
+				// Whether the body actually gets encoded depends on its
+				// size, which a 304 does not have. The validator must not
+				// differ between the two, so it is weak regardless.
+				weakenETag(head)
+			}
+			if !bodyAllowed(ri.Status) || c == "" {
 				return w
 			}
-			// Idempotent
-			if head.Get("Content-Encoding") != "" {
+			// Ranges are of the unencoded body
+			if ri.Status == http.StatusPartialContent {
 				return w
 			}
-			for _, c := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
-				// TODO: qvalue
-				c = strings.TrimSpace(c)
-				var wr io.WriteCloser
-				switch c {
-				case "deflate":
-					wr = zlib.NewWriter(w)
-				case "gzip":
-					wr = gzip.NewWriter(w)
-				default:
-					continue
-				}
+			n, err := strconv.ParseInt(head.Get("Content-Length"), 10, 64)
+			sized := err == nil
+			if sized && n < int64(opts.MinSize) {
+				return w
+			}
+			setHeaders := func() {
 				head.Set("Content-Encoding", c)
-				closer = wr
-				return wr
+				// Length of the encoded body is not known in advance
+				head.Del("Content-Length")
 			}
-			return w
-		}
-		h.ServeHTTP(wrapBody(w, f), r)
-		if closer != nil {
-			// TODO: Error?
-			closer.Close()
+			open := func() io.Writer {
+				setHeaders()
+				return opts.encoder(c, w)
+			}
+			if r.Method == "HEAD" {
+				// Same headers as GET, but nothing to encode: whatever body
+				// the handler writes is dropped by the server anyway
+				open = func() io.Writer {
+					setHeaders()
+					return w
+				}
+			}
+			if opts.MinSize <= 0 || sized {
+				return open()
+			}
+			return &prefixGate{n: opts.MinSize, decide: func(prefix []byte, done bool) io.Writer {
+				if done && r.Method == "HEAD" && len(prefix) == 0 {
+					// No body and no length: nothing says the GET would be
+					// small, so give it the headers of an encoded one
+					return open()
+				}
+				if done {
+					// Too small to bother
+					return w
+				}
+				return open()
+			}}
 		}
+		bw := WrapResponse(w, r, f)
+		h.ServeHTTP(bw, r)
+		// Errors have been reported
+		bw.Close()
 	})
 }
@@ -0,0 +1,173 @@
+// Copyright © 2013 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package godspeed
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Settings for CORS
+type CORSOptions struct {
+	// Origins allowed to make requests: exact ("https://example.com"), any
+	// subdomain ("https://*.example.com") or any origin at all ("*").
+	AllowedOrigins []string
+	// Decides on origins not matched by AllowedOrigins
+	AllowOriginFunc func(origin string) bool
+	// Allow cookies and HTTP authentication
+	AllowCredentials bool
+	// Methods allowed by preflight requests. Nil means GET, HEAD and POST.
+	AllowedMethods []string
+	// Request headers allowed by preflight requests, besides the CORS
+	// safelisted ones. "*" allows all headers.
+	AllowedHeaders []string
+	// Response headers scripts get to see, besides the CORS safelisted ones
+	ExposedHeaders []string
+	// How long browsers can cache the outcome of a preflight request. Zero
+	// leaves it to the browser.
+	MaxAge time.Duration
+}
+
+func matchOrigin(origin, pattern string) bool {
+	if pattern == "*" || origin == pattern {
+		return true
+	}
+	prefix, suffix, wild := strings.Cut(pattern, "*")
+	if !wild || !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+	if len(origin) < len(prefix)+len(suffix) {
+		return false
+	}
+	sub := origin[len(prefix) : len(origin)-len(suffix)]
+	return sub != "" && !strings.ContainsAny(sub, "/:")
+}
+
+func (o *CORSOptions) originAllowed(origin string) bool {
+	for _, p := range o.AllowedOrigins {
+		if matchOrigin(origin, p) {
+			return true
+		}
+	}
+	return o.AllowOriginFunc != nil && o.AllowOriginFunc(origin)
+}
+
+func (o *CORSOptions) methodAllowed(method string) bool {
+	methods := o.AllowedMethods
+	if methods == nil {
+		methods = []string{"GET", "HEAD", "POST"}
+	}
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *CORSOptions) headersAllowed(requested string) bool {
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		ok := false
+		for _, a := range o.AllowedHeaders {
+			if a == "*" || strings.EqualFold(a, h) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Access-Control-Allow-Origin and -Credentials
+func (o *CORSOptions) allowOrigin(head http.Header, origin string) {
+	if !o.AllowCredentials && len(o.AllowedOrigins) == 1 && o.AllowedOrigins[0] == "*" {
+		head.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		// A wildcard is not allowed with credentials
+		head.Set("Access-Control-Allow-Origin", origin)
+	}
+	if o.AllowCredentials {
+		head.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// Answer a preflight request. Not allowing it means leaving out the CORS
+// headers; the browser takes it from there.
+func (o *CORSOptions) preflight(w http.ResponseWriter, r *http.Request, origin string) {
+	head := w.Header()
+	addVary(head, "Origin")
+	addVary(head, "Access-Control-Request-Method")
+	addVary(head, "Access-Control-Request-Headers")
+	method := r.Header.Get("Access-Control-Request-Method")
+	reqHeaders := strings.Join(r.Header.Values("Access-Control-Request-Headers"), ",")
+	if o.originAllowed(origin) && o.methodAllowed(method) && o.headersAllowed(reqHeaders) {
+		o.allowOrigin(head, origin)
+		head.Set("Access-Control-Allow-Methods", method)
+		if reqHeaders != "" {
+			head.Set("Access-Control-Allow-Headers", reqHeaders)
+		}
+		if o.MaxAge > 0 {
+			head.Set("Access-Control-Max-Age",
+				strconv.FormatInt(int64(o.MaxAge/time.Second), 10))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Allow cross-origin requests from browsers. Preflight requests are answered
+// without bothering the handler. Every response is marked as varying on
+// Origin, whether it has CORS headers or not, so caches never serve one
+// origin's response to another.
+func CORS(h http.Handler, opts CORSOptions) http.Handler {
+	exposed := strings.Join(opts.ExposedHeaders, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin != "" && r.Method == "OPTIONS" &&
+			r.Header.Get("Access-Control-Request-Method") != "" {
+			opts.preflight(w, r, origin)
+			return
+		}
+		f := func(ri ResponseInfo) io.Writer {
+			head := ri.Header()
+			addVary(head, "Origin")
+			if origin != "" && opts.originAllowed(origin) {
+				opts.allowOrigin(head, origin)
+				if exposed != "" {
+					head.Set("Access-Control-Expose-Headers", exposed)
+				}
+			}
+			return ri.ResponseWriter
+		}
+		bw := WrapResponse(w, r, f)
+		h.ServeHTTP(bw, r)
+		bw.Close()
+	})
+}
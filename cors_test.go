@@ -0,0 +1,124 @@
+// Copyright © 2013 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package godspeed
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testCORSOptions = CORSOptions{
+	AllowedOrigins:   []string{"https://example.com", "https://*.example.org"},
+	AllowOriginFunc:  func(origin string) bool { return origin == "https://friend.net" },
+	AllowCredentials: true,
+	AllowedMethods:   []string{"GET", "PUT"},
+	AllowedHeaders:   []string{"Content-Type", "X-Token"},
+	ExposedHeaders:   []string{"X-Total"},
+	MaxAge:           10 * time.Minute,
+}
+
+func corsRequest(method, origin string) *http.Request {
+	r, _ := http.NewRequest(method, "/api", nil)
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	return r
+}
+
+func TestCORSOrigins(t *testing.T) {
+	h := CORS(testHandlerSimple, testCORSOptions)
+	for origin, allowed := range map[string]bool{
+		"https://example.com":           true,
+		"https://api.example.org":       true,
+		"https://a.b.example.org":       true,
+		"https://friend.net":            true,
+		"":                              false,
+		"http://example.com":            false,
+		"https://example.org":           false,
+		"https://evil.com/.example.org": false,
+		"https://example.com.evil.com":  false,
+	} {
+		rec := httptest.NewRecorder()
+		r := corsRequest("GET", origin)
+		h.ServeHTTP(rec, r)
+		assert200(t, r, rec)
+		head := rec.Result().Header
+		acao := head.Get("Access-Control-Allow-Origin")
+		if (acao != "") != allowed || (allowed && acao != origin) {
+			t.Errorf("Origin %q: Access-Control-Allow-Origin %q, allowed: %v",
+				origin, acao, allowed)
+		}
+		if vary := head.Get("Vary"); vary != "Origin" {
+			t.Errorf("Origin %q: unexpected Vary %q", origin, vary)
+		}
+		if allowed && head.Get("Access-Control-Expose-Headers") != "X-Total" {
+			t.Errorf("Origin %q: headers not exposed", origin)
+		}
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	called := false
+	h := CORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}), testCORSOptions)
+	for _, c := range []struct {
+		method, headers string
+		allowed         bool
+	}{
+		{"PUT", "content-type, x-token", true},
+		{"DELETE", "", false},
+		{"PUT", "X-Other", false},
+	} {
+		rec := httptest.NewRecorder()
+		r := corsRequest("OPTIONS", "https://example.com")
+		r.Header.Set("Access-Control-Request-Method", c.method)
+		r.Header.Set("Access-Control-Request-Headers", c.headers)
+		h.ServeHTTP(rec, r)
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("Unexpected preflight status code: %d", rec.Code)
+		}
+		head := rec.Header()
+		if allowed := head.Get("Access-Control-Allow-Methods") == c.method; allowed != c.allowed {
+			t.Errorf("Preflight %+v allowed: %v", c, allowed)
+		}
+		if c.allowed && (head.Get("Access-Control-Allow-Credentials") != "true" ||
+			head.Get("Access-Control-Max-Age") != "600" ||
+			head.Get("Access-Control-Allow-Headers") != c.headers) {
+			t.Errorf("Unexpected preflight response headers: %v", head)
+		}
+	}
+	if called {
+		t.Errorf("Handler called for preflight request")
+	}
+}
+
+func TestCORSWildcard(t *testing.T) {
+	h := CORS(testHandlerSimple, CORSOptions{AllowedOrigins: []string{"*"}})
+	rec := httptest.NewRecorder()
+	r := corsRequest("GET", "https://anywhere.com")
+	h.ServeHTTP(rec, r)
+	if acao := rec.Header().Get("Access-Control-Allow-Origin"); acao != "*" {
+		t.Errorf("Unexpected Access-Control-Allow-Origin: %q, expected: *", acao)
+	}
+}
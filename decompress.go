@@ -0,0 +1,160 @@
+// Copyright © 2013 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package godspeed
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Errors from reading a request body decoded by Decompress
+var (
+	ErrBodyTooLarge = errors.New("godspeed: decompressed request body too large")
+	ErrBodyRatio    = errors.New("godspeed: request body compression ratio too high")
+)
+
+// Limits for DecompressWithOptions, to defuse zip bombs. Zero means no limit.
+type DecompressOptions struct {
+	// Maximum size of a decoded request body in bytes
+	MaxSize int64
+	// Maximum ratio between the decoded and the encoded size of a body
+	MaxRatio float64
+}
+
+// Limits used by Decompress
+var DefaultDecompressOptions = DecompressOptions{
+	MaxSize:  32 << 20,
+	MaxRatio: 100,
+}
+
+// Bodies too small to trip the ratio check: the ratio is meaningless when the
+// encoded size is dominated by headers.
+const minRatioSize = 4 << 10
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Decoded request body that enforces the limits
+type decodedBody struct {
+	io.Reader
+	raw  *countingReader
+	body io.Closer
+	n    int64
+	err  error
+	opts *DecompressOptions
+}
+
+func (b *decodedBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.Reader.Read(p)
+	b.n += int64(n)
+	switch {
+	case b.opts.MaxSize > 0 && b.n > b.opts.MaxSize:
+		b.err = ErrBodyTooLarge
+	case b.opts.MaxRatio > 0 && b.n > minRatioSize &&
+		float64(b.n) > b.opts.MaxRatio*float64(b.raw.n):
+		b.err = ErrBodyRatio
+	default:
+		return n, err
+	}
+	return 0, b.err
+}
+
+func (b *decodedBody) Close() error {
+	return b.body.Close()
+}
+
+// Wrap a reader in a decoder for the given content coding. A nil reader means
+// the coding is not supported.
+func decoder(coding string, r io.Reader) (io.Reader, error) {
+	switch coding {
+	case "identity":
+		return r, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		// Same flavour of "deflate" as Compress produces
+		return zlib.NewReader(r)
+	}
+	return nil, nil
+}
+
+// Transparently decode request bodies sent with a Content-Encoding, using the
+// limits in DefaultDecompressOptions.
+func Decompress(h http.Handler) http.Handler {
+	return DecompressWithOptions(h, DefaultDecompressOptions)
+}
+
+// Like Decompress, with explicit limits. Every coding Compress can produce is
+// understood; requests with any other coding are answered with 415
+// Unsupported Media Type. When a limit is exceeded, reading the body fails
+// with ErrBodyTooLarge or ErrBodyRatio.
+func DecompressWithOptions(h http.Handler, opts DecompressOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encs := r.Header.Values("Content-Encoding")
+		if len(encs) == 0 || r.Body == nil || r.Body == http.NoBody {
+			h.ServeHTTP(w, r)
+			return
+		}
+		raw := &countingReader{r: r.Body}
+		var body io.Reader = raw
+		codings := strings.Split(strings.Join(encs, ","), ",")
+		// Codings are listed in the order they were applied
+		for i := len(codings) - 1; i >= 0; i-- {
+			c := strings.ToLower(strings.TrimSpace(codings[i]))
+			if c == "" {
+				continue
+			}
+			dec, err := decoder(c, body)
+			if err != nil {
+				http.Error(w, "Malformed "+c+" request body", http.StatusBadRequest)
+				return
+			}
+			if dec == nil {
+				w.Header().Set("Accept-Encoding", strings.Join(compressCodings, ", "))
+				http.Error(w, "Unsupported Content-Encoding: "+c,
+					http.StatusUnsupportedMediaType)
+				return
+			}
+			body = dec
+		}
+		r = r.Clone(r.Context())
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+		r.Body = &decodedBody{Reader: body, raw: raw, body: r.Body, opts: &opts}
+		h.ServeHTTP(w, r)
+	})
+}
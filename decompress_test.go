@@ -0,0 +1,101 @@
+// Copyright © 2013 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package godspeed
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Echo the request body, or the error reading it
+var testHandlerEcho = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if enc := r.Header.Get("Content-Encoding"); enc != "" {
+		http.Error(w, "Content-Encoding left in place: "+enc, 500)
+		return
+	}
+	w.Write(data)
+})
+
+func encodedRequest(coding string, data []byte) *http.Request {
+	var buf bytes.Buffer
+	var wr io.WriteCloser
+	switch coding {
+	case "gzip":
+		wr = gzip.NewWriter(&buf)
+	case "deflate":
+		wr = zlib.NewWriter(&buf)
+	}
+	wr.Write(data)
+	wr.Close()
+	r, _ := http.NewRequest("POST", "/upload", &buf)
+	r.Header.Set("Content-Encoding", coding)
+	return r
+}
+
+func TestDecompress(t *testing.T) {
+	for _, coding := range []string{"gzip", "deflate"} {
+		rec := httptest.NewRecorder()
+		r := encodedRequest(coding, []byte(`{"foo": 123}`))
+		Decompress(testHandlerEcho).ServeHTTP(rec, r)
+		assert200(t, r, rec)
+		if body := rec.Body.String(); body != `{"foo": 123}` {
+			t.Errorf("Unexpected %s request body: %q", coding, body)
+		}
+	}
+}
+
+func TestDecompressUnsupported(t *testing.T) {
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/upload", strings.NewReader("test"))
+	r.Header.Set("Content-Encoding", "br")
+	Decompress(testHandlerEcho).ServeHTTP(rec, r)
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Unexpected status code for unsupported coding: %d, expected: 415",
+			rec.Code)
+	}
+}
+
+func TestDecompressLimits(t *testing.T) {
+	zeros := make([]byte, 1<<20)
+	for _, opts := range []DecompressOptions{
+		{MaxSize: 1 << 10},
+		{MaxRatio: 10},
+	} {
+		rec := httptest.NewRecorder()
+		r := encodedRequest("gzip", zeros)
+		DecompressWithOptions(testHandlerEcho, opts).ServeHTTP(rec, r)
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Limits %+v not enforced: status %d", opts, rec.Code)
+		}
+	}
+}
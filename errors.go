@@ -0,0 +1,58 @@
+// Copyright © 2013 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package godspeed
+
+import (
+	"log"
+	"net/http"
+)
+
+// Receives errors that wrappers have no one else to return to, like failing
+// to write the gzip trailer after the handler has finished. The request is nil
+// for errors that do not belong to any particular request.
+type ErrorHandler interface {
+	HandleError(r *http.Request, err error)
+}
+
+// Adapter to use an ordinary function as ErrorHandler
+type ErrorHandlerFunc func(r *http.Request, err error)
+
+func (f ErrorHandlerFunc) HandleError(r *http.Request, err error) {
+	f(r, err)
+}
+
+// All godspeed wrappers report their errors here. The default logs them
+// through the standard logger.
+var DefaultErrorHandler ErrorHandler = ErrorHandlerFunc(logError)
+
+func logError(r *http.Request, err error) {
+	if r == nil {
+		log.Print("godspeed: ", err)
+	} else {
+		log.Printf("godspeed: %s %s: %v", r.Method, r.URL, err)
+	}
+}
+
+func reportError(r *http.Request, err error) {
+	if err != nil {
+		DefaultErrorHandler.HandleError(r, err)
+	}
+}
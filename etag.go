@@ -0,0 +1,172 @@
+// Copyright © 2013 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package godspeed
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ETagOptions struct {
+	// Largest body held back to compute an ETag from, 1 MiB if 0. Bigger
+	// bodies get none, and neither do flushed ones.
+	MaxSize int
+}
+
+// Strong ETag from a SHA-256 sum
+func formatETag(sum []byte) string {
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+}
+
+// Strong ETag for a body
+func hashETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return formatETag(sum[:])
+}
+
+// Split the first entity tag off a list, "" if there is none
+func scanETag(s string) (tag, rest string) {
+	s = strings.TrimLeft(s, " \t,")
+	start := 0
+	if strings.HasPrefix(s, "W/") {
+		start = 2
+	}
+	if len(s) <= start || s[start] != '"' {
+		return "", ""
+	}
+	end := strings.IndexByte(s[start+1:], '"')
+	if end == -1 {
+		return "", ""
+	}
+	end += start + 2
+	return s[:end], s[end:]
+}
+
+// Whether etag is in a list as sent in If-Match and If-None-Match, using
+// weak or strong comparison. "*" matches any current representation.
+func etagMatch(list, etag string, weak bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	if etag == "" || !weak && strings.HasPrefix(etag, "W/") {
+		return false
+	}
+	for {
+		tag, rest := scanETag(list)
+		if tag == "" {
+			return false
+		}
+		if tag == etag || weak && strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+		list = rest
+	}
+}
+
+// Evaluate the preconditions of a GET or HEAD request against the validators
+// of the selected representation, in the order of RFC 9110 section 13.2.2.
+// Returns 304, 412, or 0 if the response should go ahead.
+func checkPreconditions(r *http.Request, etag string, modified time.Time) int {
+	// HTTP dates have no fractional seconds
+	modified = modified.Truncate(time.Second)
+	if im := strings.Join(r.Header.Values("If-Match"), ","); im != "" {
+		if !etagMatch(im, etag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if t, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil && !modified.IsZero() {
+		if modified.After(t) {
+			return http.StatusPreconditionFailed
+		}
+	}
+	if inm := strings.Join(r.Header.Values("If-None-Match"), ","); inm != "" {
+		if etagMatch(inm, etag, true) {
+			return http.StatusNotModified
+		}
+	} else if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.IsZero() {
+		if !modified.After(t) {
+			return http.StatusNotModified
+		}
+	}
+	return 0
+}
+
+// Give 200 responses to GET and HEAD a strong ETag computed from the body,
+// unless the handler set one, and answer conditional requests for them with
+// 304 Not Modified or 412 Precondition Failed. The body is held back until it
+// is complete, up to 1 MiB.
+func ETag(h http.Handler) http.Handler {
+	return ETagWithOptions(h, ETagOptions{})
+}
+
+// Same as ETag, with a different limit on the body size
+func ETagWithOptions(h http.Handler, opts ETagOptions) http.Handler {
+	max := opts.MaxSize
+	if max <= 0 {
+		max = 1 << 20
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f := func(ri ResponseInfo) io.Writer {
+			w := ri.ResponseWriter
+			head := w.Header()
+			if ri.Status != http.StatusOK || r.Method != "GET" && r.Method != "HEAD" {
+				return w
+			}
+			// Answer from whatever validators the response has by now
+			conclude := func() io.Writer {
+				// Final validator first, while Content-Type is still there
+				weakenForCompress(r, head)
+				modified, _ := http.ParseTime(head.Get("Last-Modified"))
+				status := checkPreconditions(r, head.Get("ETag"), modified)
+				if status == 0 {
+					return w
+				}
+				head.Del("Content-Type")
+				head.Del("Content-Length")
+				head.Del("Content-Encoding")
+				w.WriteHeader(status)
+				return io.Discard
+			}
+			if head.Get("ETag") != "" {
+				return conclude()
+			}
+			if n, err := strconv.Atoi(head.Get("Content-Length")); err == nil && n > max {
+				return conclude()
+			}
+			return &prefixGate{n: max + 1, decide: func(body []byte, done bool) io.Writer {
+				// Handlers normally write the body on HEAD too, but one that
+				// does not has no ETag rather than that of an empty body
+				if done && (len(body) > 0 || r.Method != "HEAD") {
+					head.Set("ETag", hashETag(body))
+					head.Set("Content-Length", strconv.Itoa(len(body)))
+				}
+				return conclude()
+			}}
+		}
+		bw := WrapResponse(w, r, f)
+		h.ServeHTTP(bw, r)
+		bw.Close()
+	})
+}
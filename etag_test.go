@@ -0,0 +1,183 @@
+// Copyright © 2013 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package godspeed
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func etagRequest(h http.Handler, method string, head map[string]string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest(method, "/page", nil)
+	for k, v := range head {
+		r.Header.Set(k, v)
+	}
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestETag(t *testing.T) {
+	h := ETag(testHandlerType("text/html", "hello"))
+	rec := etagRequest(h, "GET", nil)
+	etag := rec.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `"`) || rec.Body.String() != "hello" {
+		t.Fatalf("Unexpected response: %q %q", etag, rec.Body.String())
+	}
+	if head := etagRequest(h, "HEAD", nil); head.Header().Get("ETag") != etag {
+		t.Errorf("ETag of HEAD: %q, expected: %q", head.Header().Get("ETag"), etag)
+	}
+	if rec := etagRequest(h, "HEAD", map[string]string{"If-None-Match": etag}); rec.Code != 304 {
+		t.Errorf("Conditional HEAD: %d, expected: 304", rec.Code)
+	}
+	if other := etagRequest(ETag(testHandlerSimple), "GET", nil).Header().Get("ETag"); other == etag {
+		t.Errorf("Same ETag for different bodies: %q", etag)
+	}
+	for _, c := range []struct {
+		head   map[string]string
+		status int
+	}{
+		{map[string]string{"If-None-Match": etag}, 304},
+		{map[string]string{"If-None-Match": `"x", W/` + etag}, 304},
+		{map[string]string{"If-None-Match": "*"}, 304},
+		{map[string]string{"If-None-Match": `"x"`}, 200},
+		{map[string]string{"If-Match": etag}, 200},
+		{map[string]string{"If-Match": "*"}, 200},
+		{map[string]string{"If-Match": "W/" + etag}, 412},
+		{map[string]string{"If-Match": `"x"`}, 412},
+	} {
+		rec := etagRequest(h, "GET", c.head)
+		if rec.Code != c.status {
+			t.Errorf("Status for %v: %d, expected: %d", c.head, rec.Code, c.status)
+		}
+		if c.status != 200 {
+			if rec.Body.Len() != 0 || rec.Header().Get("Content-Type") != "" {
+				t.Errorf("Body or content headers for %d: %q %q", c.status,
+					rec.Body.String(), rec.Header().Get("Content-Type"))
+			}
+		}
+	}
+}
+
+func TestETagLastModified(t *testing.T) {
+	mod := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	h := ETag(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", mod.Format(http.TimeFormat))
+		fmt.Fprint(w, "hello")
+	}))
+	before := mod.Add(-time.Hour).Format(http.TimeFormat)
+	after := mod.Add(time.Hour).Format(http.TimeFormat)
+	for _, c := range []struct {
+		head   map[string]string
+		status int
+	}{
+		{map[string]string{"If-Modified-Since": after}, 304},
+		{map[string]string{"If-Modified-Since": mod.Format(http.TimeFormat)}, 304},
+		{map[string]string{"If-Modified-Since": before}, 200},
+		{map[string]string{"If-Modified-Since": "garbage"}, 200},
+		{map[string]string{"If-Unmodified-Since": before}, 412},
+		{map[string]string{"If-Unmodified-Since": after}, 200},
+		// If-None-Match wins over If-Modified-Since
+		{map[string]string{"If-None-Match": `"x"`, "If-Modified-Since": after}, 200},
+	} {
+		if rec := etagRequest(h, "GET", c.head); rec.Code != c.status {
+			t.Errorf("Status for %v: %d, expected: %d", c.head, rec.Code, c.status)
+		}
+	}
+}
+
+// The handler's own ETag is used as is, without holding back the body
+func TestETagFromHandler(t *testing.T) {
+	h := ETag(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `W/"v1"`)
+		fmt.Fprint(w, "hello")
+	}))
+	if rec := etagRequest(h, "GET", map[string]string{"If-None-Match": `"v1"`}); rec.Code != 304 {
+		t.Errorf("Weak comparison failed: %d", rec.Code)
+	}
+	if rec := etagRequest(h, "HEAD", map[string]string{"If-None-Match": `W/"v1"`}); rec.Code != 304 {
+		t.Errorf("Conditional HEAD: %d", rec.Code)
+	}
+	if rec := etagRequest(h, "GET", map[string]string{"If-Match": `W/"v1"`}); rec.Code != 412 {
+		t.Errorf("Weak ETag passed strong comparison: %d", rec.Code)
+	}
+}
+
+func TestETagSkipped(t *testing.T) {
+	big := strings.Repeat("x", 100)
+	h := ETagWithOptions(testHandlerType("text/plain", big), ETagOptions{MaxSize: 10})
+	if rec := etagRequest(h, "GET", nil); rec.Header().Get("ETag") != "" || rec.Body.String() != big {
+		t.Errorf("Body over MaxSize got an ETag")
+	}
+	notFound := ETag(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusNotFound)
+	}))
+	if rec := etagRequest(notFound, "GET", map[string]string{"If-None-Match": "*"}); rec.Code != 404 || rec.Header().Get("ETag") != "" {
+		t.Errorf("Error response touched: %d %q", rec.Code, rec.Header().Get("ETag"))
+	}
+	if rec := etagRequest(ETag(testHandlerSimple), "POST", nil); rec.Header().Get("ETag") != "" {
+		t.Errorf("ETag on POST response")
+	}
+}
+
+// Inside Compress the ETag is computed from the identity body, and weakened
+func TestETagCompress(t *testing.T) {
+	h := Compress(ETag(testHandlerType("text/plain", "hello")))
+	plain := etagRequest(h, "GET", nil).Header().Get("ETag")
+	rec := etagRequest(h, "GET", map[string]string{"Accept-Encoding": "gzip"})
+	if etag := rec.Header().Get("ETag"); etag != "W/"+plain {
+		t.Fatalf("ETag of compressed response: %q, expected: W/%s", etag, plain)
+	}
+	rec = etagRequest(h, "GET", map[string]string{
+		"Accept-Encoding": "gzip",
+		"If-None-Match":   "W/" + plain,
+	})
+	if rec.Code != 304 || rec.Header().Get("Content-Encoding") != "" || rec.Body.Len() != 0 {
+		t.Errorf("Unexpected conditional compressed response: %d %q", rec.Code, rec.Body.String())
+	}
+	// The 304 has the same validator as the 200 it stands for
+	if etag := rec.Header().Get("ETag"); etag != "W/"+plain {
+		t.Errorf("ETag of 304 for compressed response: %q, expected: W/%s", etag, plain)
+	}
+	rec = etagRequest(h, "GET", map[string]string{"If-None-Match": plain})
+	if etag := rec.Header().Get("ETag"); rec.Code != 304 || etag != plain {
+		t.Errorf("Unexpected 304 for identity response: %d %q", rec.Code, etag)
+	}
+}
+
+// Too small to be encoded still means a weak validator, for the 200 and the
+// 304 alike
+func TestETagCompressMinSize(t *testing.T) {
+	h := CompressWithOptions(ETag(testHandlerType("text/plain", "test")), CompressOptions{MinSize: 100})
+	rec := etagRequest(h, "GET", map[string]string{"Accept-Encoding": "gzip"})
+	etag := rec.Header().Get("ETag")
+	if rec.Header().Get("Content-Encoding") != "" || !strings.HasPrefix(etag, "W/") {
+		t.Fatalf("Unexpected small response: %q %q", rec.Header().Get("Content-Encoding"), etag)
+	}
+	rec = etagRequest(h, "GET", map[string]string{"Accept-Encoding": "gzip", "If-None-Match": etag})
+	if rec.Code != 304 || rec.Header().Get("ETag") != etag {
+		t.Errorf("Unexpected 304: %d %q, expected ETag: %q", rec.Code, rec.Header().Get("ETag"), etag)
+	}
+}
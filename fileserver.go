@@ -0,0 +1,329 @@
+// Copyright © 2013 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package godspeed
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// A hash-like part just before the extension, as in app.3f2a1b4c.js or
+// index-BqJ3x9aF.js
+var fingerprint = regexp.MustCompile(`[.-]([0-9A-Za-z_]{8,})\.[^.]+$`)
+
+// Whether a file name contains a content hash. The hash has to mix digits
+// and letters, so names like build-20240101.js don't count.
+func fingerprinted(name string) bool {
+	m := fingerprint.FindStringSubmatch(name)
+	if m == nil {
+		return false
+	}
+	return strings.IndexFunc(m[1], unicode.IsDigit) != -1 &&
+		strings.IndexFunc(m[1], unicode.IsLetter) != -1
+}
+
+type FileServerOptions struct {
+	// Mime-types by file name, DefaultMimeRegistry if nil. Files of unknown
+	// type are sniffed.
+	Registry *MimeRegistry
+	// Charset added to textual types without one, as with Mimetype
+	Charset string
+	// File served for a directory, "index.html" if empty
+	Index string
+	// File served instead of a 404 for paths without extension, e.g.
+	// "index.html" for a single page app doing its own routing
+	Fallback string
+	// List directories without index file, as HTML or, if the client asks
+	// for it, JSON
+	Listing bool
+	// Whether a file name contains a hash of its content, so the file can
+	// be cached forever. Defaults to names like app.3f2a1b4c.js and
+	// index-BqJ3x9aF.js.
+	Fingerprinted func(name string) bool
+	// On the fly compression of files without precompressed sibling
+	Compress CompressOptions
+}
+
+// ETag of a file, valid as long as its modification time and size are
+type fileTag struct {
+	modified time.Time
+	size     int64
+	etag     string
+}
+
+type fileServer struct {
+	fsys fs.FS
+	root http.FileSystem
+	opts FileServerOptions
+	// By file path
+	etags sync.Map
+}
+
+// Serve files from fsys, e.g. an embed.FS, with everything this package has to
+// offer:
+//
+// - Content-Type from a MimeRegistry, or sniffed
+//
+// - Precompressed siblings as with PrecompressedFileServer, other files
+// compressed on the fly
+//
+// - Strong ETags from the SHA-256 of the file contents, computed once per
+// modification, with conditional and range requests handled by
+// http.ServeContent
+//
+// - Cache-Control: immutable for fingerprinted file names
+//
+// - Index files for directories, directory listings if enabled, and a
+// fallback document for single page apps
+func FileServer(fsys fs.FS, opts FileServerOptions) http.Handler {
+	if opts.Registry == nil {
+		opts.Registry = DefaultMimeRegistry
+	}
+	if opts.Index == "" {
+		opts.Index = "index.html"
+	}
+	if opts.Fingerprinted == nil {
+		opts.Fingerprinted = fingerprinted
+	}
+	s := &fileServer{fsys: fsys, root: http.FS(fsys), opts: opts}
+	return CompressWithOptions(s, opts.Compress)
+}
+
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Empty under http.StripPrefix when the prefix is all there is
+	rpath := r.URL.Path
+	if !strings.HasPrefix(rpath, "/") {
+		rpath = "/" + rpath
+	}
+	upath := path.Clean(rpath)
+	name := strings.TrimPrefix(upath, "/")
+	if name == "" {
+		name = "."
+	}
+	stat, err := fs.Stat(s.fsys, name)
+	if err == nil && stat.IsDir() {
+		if !strings.HasSuffix(rpath, "/") {
+			// Relative links in the index must resolve inside the directory.
+			// The redirect is relative too, so it works behind
+			// http.StripPrefix.
+			target := path.Base(upath) + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			w.Header().Set("Location", target)
+			w.WriteHeader(http.StatusMovedPermanently)
+			return
+		}
+		index := path.Join(name, s.opts.Index)
+		if istat, err := fs.Stat(s.fsys, index); err == nil && !istat.IsDir() {
+			s.serveFile(w, r, index)
+			return
+		}
+		if s.opts.Listing {
+			s.list(w, r, name, upath)
+			return
+		}
+		err = fs.ErrNotExist
+	}
+	if errors.Is(err, fs.ErrNotExist) && s.opts.Fallback != "" && path.Ext(upath) == "" {
+		name = s.opts.Fallback
+		err = nil
+	}
+	if err != nil {
+		s.error(w, r, err)
+		return
+	}
+	s.serveFile(w, r, name)
+}
+
+func (s *fileServer) error(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "404 page not found", http.StatusNotFound)
+	case errors.Is(err, fs.ErrPermission):
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+	default:
+		reportError(r, err)
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func (s *fileServer) serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	upath := "/" + name
+	head := w.Header()
+	f, stat, coding := openPrecompressed(r, s.root, upath)
+	served := upath
+	if f == nil {
+		var err error
+		if f, err = s.root.Open(upath); err == nil {
+			stat, err = f.Stat()
+		}
+		if err == nil && stat.IsDir() {
+			err = fs.ErrNotExist
+		}
+		if err != nil {
+			if f != nil {
+				f.Close()
+			}
+			s.error(w, r, err)
+			return
+		}
+	} else {
+		served += precompressedExts[coding]
+	}
+	defer f.Close()
+	ctype := s.opts.Registry.TypeByPath(name)
+	if ctype == "" && coding == "" {
+		// Sniffed here rather than by ServeContent, so the type is known
+		// when settling the validator
+		var err error
+		if ctype, err = sniffFile(f); err != nil {
+			s.error(w, r, err)
+			return
+		}
+	}
+	if ctype != "" && s.opts.Charset != "" {
+		ctype = withCharset(ctype, s.opts.Charset)
+	}
+	if coding != "" {
+		setPrecompressedHeaders(head, ctype, coding)
+	} else {
+		head.Set("Content-Type", ctype)
+	}
+	if etag, err := s.etag(served, f, stat); err == nil {
+		head.Set("ETag", etag)
+		// Weak if Compress may encode it: ServeContent drops Content-Type
+		// from a 304, so Compress can not tell by then
+		weakenForCompress(r, head)
+	} else {
+		reportError(r, fmt.Errorf("hashing %s: %w", served, err))
+	}
+	if s.opts.Fingerprinted(path.Base(name)) {
+		head.Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	http.ServeContent(w, r, name, stat.ModTime(), f)
+}
+
+// Type of a file by its first bytes. The file is rewound afterwards.
+func sniffFile(f io.ReadSeeker) (string, error) {
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return sniffType(buf[:n]), nil
+}
+
+// Strong ETag of a file, from cache if it has not changed
+func (s *fileServer) etag(name string, f io.ReadSeeker, stat fs.FileInfo) (string, error) {
+	if v, ok := s.etags.Load(name); ok {
+		t := v.(fileTag)
+		if t.modified.Equal(stat.ModTime()) && t.size == stat.Size() {
+			return t.etag, nil
+		}
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	etag := formatETag(h.Sum(nil))
+	s.etags.Store(name, fileTag{modified: stat.ModTime(), size: stat.Size(), etag: etag})
+	return etag, nil
+}
+
+// Whether the client wants JSON rather than HTML. Accept works like
+// Accept-Encoding as long as there are no wildcards, which mean HTML here.
+func acceptsJSON(r *http.Request) bool {
+	supported := []string{"text/html", "application/json"}
+	return negotiateEncoding(r.Header.Get("Accept"), supported) == "application/json"
+}
+
+// Entry in a JSON directory listing
+type listEntry struct {
+	Name     string `json:"name"`
+	Dir      bool   `json:"dir,omitempty"`
+	Size     int64  `json:"size"`
+	Modified string `json:"modified,omitempty"`
+}
+
+func (s *fileServer) list(w http.ResponseWriter, r *http.Request, name, upath string) {
+	entries, err := fs.ReadDir(s.fsys, name)
+	if err != nil {
+		s.error(w, r, err)
+		return
+	}
+	head := w.Header()
+	addVary(head, "Accept")
+	if acceptsJSON(r) {
+		list := make([]listEntry, 0, len(entries))
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			le := listEntry{Name: e.Name(), Dir: e.IsDir(), Size: info.Size()}
+			if !info.ModTime().IsZero() {
+				le.Modified = info.ModTime().UTC().Format(time.RFC3339)
+			}
+			list = append(list, le)
+		}
+		head.Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+	head.Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<!doctype html>\n<meta name=\"viewport\" content=\"width=device-width\">\n<title>%s</title>\n<pre>\n",
+		html.EscapeString(upath))
+	for _, e := range entries {
+		n := e.Name()
+		if e.IsDir() {
+			n += "/"
+		}
+		// Names with a colon would otherwise look like a URL scheme
+		u := url.URL{Path: n}
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", html.EscapeString(u.String()), html.EscapeString(n))
+	}
+	fmt.Fprint(w, "</pre>\n")
+}
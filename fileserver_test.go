@@ -0,0 +1,235 @@
+// Copyright © 2013 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package godspeed
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+var testSite = fstest.MapFS{
+	"index.html":           {Data: []byte("<!doctype html><title>home</title>")},
+	"app.3f2a1b4c.js":      {Data: []byte("console.log('app')")},
+	"app.3f2a1b4c.js.br":   {Data: []byte("brotli")},
+	"style.css":            {Data: []byte("body { color: red }")},
+	"data":                 {Data: []byte("%PDF-1.7")},
+	"docs/index.html":      {Data: []byte("<p>docs")},
+	"files/a.txt":          {Data: []byte("a")},
+	"files/<b>.txt":        {Data: []byte("b")},
+	"files/sub/nested.txt": {Data: []byte("c")},
+}
+
+func serveFile(h http.Handler, target string, head map[string]string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", target, nil)
+	for k, v := range head {
+		r.Header.Set(k, v)
+	}
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestFileServer(t *testing.T) {
+	h := FileServer(testSite, FileServerOptions{Charset: "utf-8"})
+	for target, expected := range map[string]string{
+		"/":                "<!doctype html><title>home</title>",
+		"/docs/":           "<p>docs",
+		"/app.3f2a1b4c.js": "console.log('app')",
+		"/../style.css":    "body { color: red }",
+	} {
+		rec := serveFile(h, target, nil)
+		if rec.Code != 200 || rec.Body.String() != expected {
+			t.Errorf("%s: %d %q, expected: %q", target, rec.Code, rec.Body.String(), expected)
+		}
+	}
+	for target, ctype := range map[string]string{
+		"/app.3f2a1b4c.js": "text/javascript; charset=utf-8",
+		"/style.css":       "text/css; charset=utf-8",
+		"/data":            "application/pdf",
+	} {
+		if ct := serveFile(h, target, nil).Header().Get("Content-Type"); ct != ctype {
+			t.Errorf("%s: Content-Type %q, expected: %q", target, ct, ctype)
+		}
+	}
+	if rec := serveFile(h, "/docs?x=1", nil); rec.Code != 301 || rec.Header().Get("Location") != "docs/?x=1" {
+		t.Errorf("Directory without slash: %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	// Nothing left of the path after StripPrefix
+	stripped := http.StripPrefix("/static", h)
+	if rec := serveFile(stripped, "/static", nil); rec.Code != 200 || rec.Header().Get("Location") != "" {
+		t.Errorf("Root under StripPrefix: %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if rec := serveFile(stripped, "/static/docs", nil); rec.Header().Get("Location") != "docs/" {
+		t.Errorf("Directory under StripPrefix: %q", rec.Header().Get("Location"))
+	}
+	for _, target := range []string{"/missing", "/files/", "/app.js"} {
+		if rec := serveFile(h, target, nil); rec.Code != 404 {
+			t.Errorf("%s: %d, expected: 404", target, rec.Code)
+		}
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/", nil))
+	if rec.Code != 405 {
+		t.Errorf("POST: %d, expected: 405", rec.Code)
+	}
+}
+
+func TestFileServerCaching(t *testing.T) {
+	h := FileServer(testSite, FileServerOptions{})
+	rec := serveFile(h, "/style.css", nil)
+	etag := rec.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("Unexpected ETag: %q", etag)
+	}
+	if cc := rec.Header().Get("Cache-Control"); cc != "" {
+		t.Errorf("Cache-Control for plain name: %q", cc)
+	}
+	if again := serveFile(h, "/style.css", nil).Header().Get("ETag"); again != etag {
+		t.Errorf("ETag changed: %q, then %q", etag, again)
+	}
+	if rec := serveFile(h, "/style.css", map[string]string{"If-None-Match": etag}); rec.Code != 304 {
+		t.Errorf("Conditional request: %d, expected: 304", rec.Code)
+	}
+	if rec := serveFile(h, "/style.css", map[string]string{"Range": "bytes=0-3"}); rec.Code != 206 || rec.Body.String() != "body" {
+		t.Errorf("Range request: %d %q", rec.Code, rec.Body.String())
+	}
+	rec = serveFile(h, "/app.3f2a1b4c.js", nil)
+	if cc := rec.Header().Get("Cache-Control"); cc != "public, max-age=31536000, immutable" {
+		t.Errorf("Cache-Control for fingerprinted name: %q", cc)
+	}
+}
+
+func TestFileServerCompression(t *testing.T) {
+	h := FileServer(testSite, FileServerOptions{})
+	plain := serveFile(h, "/app.3f2a1b4c.js", nil)
+	rec := serveFile(h, "/app.3f2a1b4c.js", map[string]string{"Accept-Encoding": "br, gzip"})
+	if rec.Header().Get("Content-Encoding") != "br" || rec.Body.String() != "brotli" {
+		t.Errorf("Precompressed sibling not served: %q", rec.Header())
+	}
+	if rec.Header().Get("ETag") == plain.Header().Get("ETag") {
+		t.Errorf("Same ETag for identity and br")
+	}
+	rec = serveFile(h, "/style.css", map[string]string{"Accept-Encoding": "br, gzip"})
+	if rec.Header().Get("Content-Encoding") != "gzip" || decode(t, rec) != "body { color: red }" {
+		t.Errorf("Not compressed on the fly: %q", rec.Header())
+	}
+	if vary := rec.Header().Get("Vary"); vary != "Accept-Encoding" {
+		t.Errorf("Unexpected Vary: %q", vary)
+	}
+}
+
+// A conditional GET gets the validator of the 200 it stands for
+func TestFileServerConditional(t *testing.T) {
+	h := FileServer(testSite, FileServerOptions{})
+	for target, weak := range map[string]bool{
+		// Compressed on the fly
+		"/style.css": true,
+		// Sniffed, not compressable
+		"/data": false,
+	} {
+		gzip := map[string]string{"Accept-Encoding": "gzip"}
+		etag := serveFile(h, target, gzip).Header().Get("ETag")
+		if strings.HasPrefix(etag, "W/") != weak {
+			t.Errorf("%s: ETag %q, expected weak: %v", target, etag, weak)
+		}
+		gzip["If-None-Match"] = etag
+		rec := serveFile(h, target, gzip)
+		if rec.Code != 304 || rec.Header().Get("ETag") != etag {
+			t.Errorf("%s: conditional GET %d %q, expected: 304 %q", target, rec.Code, rec.Header().Get("ETag"), etag)
+		}
+	}
+}
+
+func TestFileServerFallback(t *testing.T) {
+	h := FileServer(testSite, FileServerOptions{Fallback: "index.html"})
+	if rec := serveFile(h, "/users/42", nil); rec.Code != 200 || !strings.Contains(rec.Body.String(), "home") {
+		t.Errorf("No fallback: %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := serveFile(h, "/missing.js", nil); rec.Code != 404 {
+		t.Errorf("Fallback for missing asset: %d", rec.Code)
+	}
+}
+
+func TestFileServerListing(t *testing.T) {
+	h := FileServer(testSite, FileServerOptions{Listing: true})
+	rec := serveFile(h, "/files/", nil)
+	body := rec.Body.String()
+	for _, s := range []string{`<a href="a.txt">a.txt</a>`, `<a href="sub/">sub/</a>`, `&lt;b&gt;.txt`} {
+		if !strings.Contains(body, s) {
+			t.Errorf("Listing lacks %q: %s", s, body)
+		}
+	}
+	if strings.Contains(body, "<b>") {
+		t.Errorf("Unescaped name in listing: %s", body)
+	}
+	rec = serveFile(h, "/files/", map[string]string{"Accept": "application/json"})
+	var list []listEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 || list[2].Name != "sub" || !list[2].Dir || list[0].Size != 1 {
+		t.Errorf("Unexpected JSON listing: %+v", list)
+	}
+	if vary := rec.Header().Values("Vary"); !strings.Contains(strings.Join(vary, ","), "Accept") {
+		t.Errorf("Listing does not vary on Accept: %q", vary)
+	}
+}
+
+//go:embed testdata/site
+var testEmbed embed.FS
+
+func TestFileServerEmbed(t *testing.T) {
+	site, err := fs.Sub(testEmbed, "testdata/site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := FileServer(site, FileServerOptions{})
+	if rec := serveFile(h, "/", nil); rec.Code != 200 || !strings.Contains(rec.Body.String(), "embedded") {
+		t.Errorf("Unexpected index: %d %q", rec.Code, rec.Body.String())
+	}
+	rec := serveFile(h, "/app.3f2a1b4c.js", nil)
+	if rec.Header().Get("ETag") == "" || rec.Header().Get("Cache-Control") == "" {
+		t.Errorf("Missing caching headers: %q", rec.Header())
+	}
+}
+
+func TestFingerprinted(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"app.3f2a1b4c.js":      true,
+		"index-BqJ3x9aF.js":    true,
+		"main.0123abcd.css":    true,
+		"app.js":               false,
+		"build-20240101.js":    false,
+		"some-long-name-v2.js": false,
+		"jquery-3.7.1.min.js":  false,
+		"my-component-file.js": false,
+	} {
+		if fingerprinted(name) != expected {
+			t.Errorf("fingerprinted(%q) != %v", name, expected)
+		}
+	}
+}
@@ -23,7 +23,10 @@ package godspeed
 import (
 	"bytes"
 	"compress/gzip"
+	"compress/zlib"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -72,6 +75,98 @@ func TestMimetype(t *testing.T) {
 	testContentType(t, r, rec, "application/json")
 }
 
+func TestMimetypeSniff(t *testing.T) {
+	sniff := MimetypeOptions{Sniff: true}
+	for body, expected := range map[string]string{
+		"<!DOCTYPE html><p>hi":                     "text/html; charset=utf-8",
+		"%PDF-1.7 ...":                             "application/pdf",
+		"\x00asm\x01\x00\x00\x00":                  "application/wasm",
+		"wOF2\x00\x01\x00\x00":                     "font/woff2",
+		"\x00\x00\x00\x1cftypavif\x00\x00\x00\x00": "image/avif",
+		"\x00\x01\x02\x03":                         "application/octet-stream",
+		"":                                         "",
+	} {
+		rec := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/download", nil)
+		MimetypeWithOptions(testHandlerType("", body), sniff).ServeHTTP(rec, r)
+		assert200(t, r, rec)
+		testContentType(t, r, rec, expected)
+		if rec.Body.String() != body {
+			t.Errorf("Body mangled by sniffing: %q, expected: %q", rec.Body.String(), body)
+		}
+	}
+	// Extension and handler still take precedence
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/test.txt", nil)
+	MimetypeWithOptions(testHandlerType("", "<html>"), sniff).ServeHTTP(rec, r)
+	testContentType(t, r, rec, "text/plain; charset=utf-8")
+	rec = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/download", nil)
+	MimetypeWithOptions(testHandlerJSON, sniff).ServeHTTP(rec, r)
+	testContentType(t, r, rec, "application/json")
+	// Off by default
+	rec = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/download", nil)
+	Mimetype(testHandlerType("", "%PDF-1.7")).ServeHTTP(rec, r)
+	if ct := rec.Header().Get("Content-Type"); ct != "" {
+		t.Errorf("Unexpected Content-Type without sniffing: %q", ct)
+	}
+}
+
+func TestMimetypeCharset(t *testing.T) {
+	opts := MimetypeOptions{Charset: "utf-8", Sniff: true}
+	for ctype, expected := range map[string]string{
+		"text/html":                     "text/html; charset=utf-8",
+		"text/html; charset=iso-8859-1": "text/html; charset=iso-8859-1",
+		"application/javascript":        "application/javascript; charset=utf-8",
+		"application/json":              "application/json; charset=utf-8",
+		"application/problem+json":      "application/problem+json; charset=utf-8",
+		"image/svg+xml":                 "image/svg+xml; charset=utf-8",
+		"image/png":                     "image/png",
+		"application/octet-stream":      "application/octet-stream",
+		"font/woff2":                    "font/woff2",
+	} {
+		rec := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/test", nil)
+		MimetypeWithOptions(testHandlerType(ctype, "test"), opts).ServeHTTP(rec, r)
+		testContentType(t, r, rec, expected)
+	}
+	// From the registry and from sniffing
+	for p, expected := range map[string]string{
+		"/a.json":  "application/json; charset=utf-8",
+		"/a.png":   "image/png",
+		"/sniffed": "text/plain; charset=utf-8",
+	} {
+		rec := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", p, nil)
+		MimetypeWithOptions(testHandlerType("", "test"), opts).ServeHTTP(rec, r)
+		testContentType(t, r, rec, expected)
+	}
+	// Not without asking
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/test", nil)
+	Mimetype(testHandlerType("text/html", "test")).ServeHTTP(rec, r)
+	testContentType(t, r, rec, "text/html")
+}
+
+// The sniffed type must be known by the time Compress decides
+func TestMimetypeSniffCompress(t *testing.T) {
+	body := strings.Repeat("<p>hello</p>", 100)
+	h := CompressWithOptions(MimetypeWithOptions(testHandlerType("", body),
+		MimetypeOptions{Sniff: true}), CompressOptions{MinSize: 1})
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/page", nil)
+	r.Header.Add("Accept-Encoding", "gzip")
+	h.ServeHTTP(rec, r)
+	testContentType(t, r, rec, "text/html; charset=utf-8")
+	if enc := rec.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Errorf("Sniffed HTML not compressed: %q", enc)
+	}
+	if got := decode(t, rec); got != body {
+		t.Errorf("Unexpected response decompressed: %q", got)
+	}
+}
+
 func TestCompress(t *testing.T) {
 	rec := httptest.NewRecorder()
 	rec.Body = bytes.NewBuffer(nil)
@@ -115,3 +210,366 @@ func TestNoCompress(t *testing.T) {
 		t.Errorf("Unexpected uncompressed response: %v, expected: 'test'", data)
 	}
 }
+
+func testHandlerType(ctype, body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ctype)
+		fmt.Fprint(w, body)
+	})
+}
+
+func compressedWith(t *testing.T, h http.Handler) string {
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/test", nil)
+	r.Header.Add("Accept-Encoding", "gzip")
+	h.ServeHTTP(rec, r)
+	assert200(t, r, rec)
+	return rec.Header().Get("Content-Encoding")
+}
+
+func TestCompressTypes(t *testing.T) {
+	for ctype, expected := range map[string]string{
+		"image/svg+xml":             "gzip",
+		"application/manifest+json": "gzip",
+		"application/xhtml+xml":     "gzip",
+		"application/wasm":          "gzip",
+		"Text/HTML; charset=utf-8":  "gzip",
+		"image/png":                 "",
+		"application/octet-stream":  "",
+		"font/woff2":                "",
+	} {
+		enc := compressedWith(t, Compress(testHandlerType(ctype, "test")))
+		if enc != expected {
+			t.Errorf("Content-Encoding for %q: %q, expected: %q",
+				ctype, enc, expected)
+		}
+	}
+	opts := CompressOptions{
+		Types:        []string{"image/"},
+		ExcludeTypes: []string{"image/png"},
+	}
+	if enc := compressedWith(t, CompressWithOptions(testHandlerType("image/bmp", "test"), opts)); enc != "gzip" {
+		t.Errorf("image/bmp not compressed with custom types")
+	}
+	if enc := compressedWith(t, CompressWithOptions(testHandlerType("image/png", "test"), opts)); enc != "" {
+		t.Errorf("Excluded type image/png compressed anyway")
+	}
+	if enc := compressedWith(t, CompressWithOptions(testHandlerType("text/plain", "test"), opts)); enc != "" {
+		t.Errorf("text/plain compressed despite custom types")
+	}
+}
+
+func TestCompressMinSize(t *testing.T) {
+	opts := CompressOptions{MinSize: 10, Level: gzip.BestSpeed}
+	// Below the threshold: sent as is
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/test.txt", nil)
+	r.Header.Add("Accept-Encoding", "gzip")
+	CompressWithOptions(Mimetype(testHandlerSimple), opts).ServeHTTP(rec, r)
+	assert200(t, r, rec)
+	if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+		t.Fatalf("Small response unexpectedly encoded as %q", enc)
+	}
+	if body := rec.Body.String(); body != "test" {
+		t.Errorf("Unexpected small response: %q, expected: 'test'", body)
+	}
+	// Above the threshold, written in pieces
+	big := strings.Repeat("0123456789", 10)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		for i := 0; i < len(big); i += 3 {
+			fmt.Fprint(w, big[i:min(i+3, len(big))])
+		}
+	})
+	rec = httptest.NewRecorder()
+	CompressWithOptions(h, opts).ServeHTTP(rec, r)
+	assert200(t, r, rec)
+	if enc := rec.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Big response encoded as %q, expected gzip", enc)
+	}
+	reader, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != big {
+		t.Errorf("Unexpected response decompressed: %q, expected: %q", data, big)
+	}
+}
+
+func TestCompressHeaders(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", "4")
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("Vary", "Origin")
+		fmt.Fprint(w, "test")
+	})
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/test.txt", nil)
+	r.Header.Add("Accept-Encoding", "gzip")
+	Compress(h).ServeHTTP(rec, r)
+	assert200(t, r, rec)
+	head := rec.Header()
+	if cl := head.Get("Content-Length"); cl != "" {
+		t.Errorf("Stale Content-Length on compressed response: %q", cl)
+	}
+	if etag := head.Get("ETag"); etag != `W/"abc"` {
+		t.Errorf("Unexpected ETag on compressed response: %q, expected: W/\"abc\"", etag)
+	}
+	if vary := head.Values("Vary"); len(vary) != 2 || vary[1] != "Accept-Encoding" {
+		t.Errorf("Unexpected Vary on compressed response: %q", vary)
+	}
+	// Not compressed: headers intact, but still Vary
+	rec = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/test.txt", nil)
+	Compress(h).ServeHTTP(rec, r)
+	assert200(t, r, rec)
+	head = rec.Header()
+	if cl := head.Get("Content-Length"); cl != "4" {
+		t.Errorf("Unexpected Content-Length on identity response: %q", cl)
+	}
+	if etag := head.Get("ETag"); etag != `"abc"` {
+		t.Errorf("Unexpected ETag on identity response: %q", etag)
+	}
+	if vary := head.Values("Vary"); len(vary) != 2 || vary[1] != "Accept-Encoding" {
+		t.Errorf("Unexpected Vary on identity response: %q", vary)
+	}
+}
+
+func decode(t *testing.T, rec *httptest.ResponseRecorder) string {
+	var reader io.Reader
+	var err error
+	switch enc := rec.Header().Get("Content-Encoding"); enc {
+	case "gzip":
+		reader, err = gzip.NewReader(rec.Body)
+	case "deflate":
+		reader, err = zlib.NewReader(rec.Body)
+	case "":
+		reader = rec.Body
+	default:
+		t.Fatalf("Unexpected Content-Encoding: %q", enc)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// Recycled encoders must not leak state between responses
+func TestCompressReuse(t *testing.T) {
+	h := Compress(testHandlerType("text/plain", "test"))
+	for i := 0; i < 6; i++ {
+		enc := [...]string{"gzip", "deflate"}[i%2]
+		rec := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/test.txt", nil)
+		r.Header.Add("Accept-Encoding", enc)
+		h.ServeHTTP(rec, r)
+		assert200(t, r, rec)
+		if got := rec.Header().Get("Content-Encoding"); got != enc {
+			t.Fatalf("Response %d encoded as %q, expected: %q", i, got, enc)
+		}
+		if body := decode(t, rec); body != "test" {
+			t.Errorf("Unexpected response %d decompressed: %q, expected: 'test'", i, body)
+		}
+	}
+}
+
+var benchBody = strings.Repeat("All work and no play makes Jack a dull boy. ", 100)
+
+func benchmarkGzip(b *testing.B, h http.Handler) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		r, _ := http.NewRequest("GET", "/test.txt", nil)
+		r.Header.Add("Accept-Encoding", "gzip")
+		for pb.Next() {
+			h.ServeHTTP(httptest.NewRecorder(), r)
+		}
+	})
+}
+
+func BenchmarkCompress(b *testing.B) {
+	benchmarkGzip(b, Compress(testHandlerType("text/plain", benchBody)))
+}
+
+// Reference: the same path, with a new encoder for every response
+func BenchmarkCompressUnpooled(b *testing.B) {
+	opts := CompressOptions{unpooled: true}
+	benchmarkGzip(b, CompressWithOptions(testHandlerType("text/plain", benchBody), opts))
+}
+
+// Every flush must push the data written so far through the encoder
+func TestCompressFlush(t *testing.T) {
+	flushed := make(chan string, 2)
+	rec := httptest.NewRecorder()
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		for _, s := range []string{"hello ", "world"} {
+			fmt.Fprint(w, s)
+			w.(http.Flusher).Flush()
+			if !rec.Flushed {
+				t.Fatal("Flush not propagated to the response writer")
+			}
+			reader, err := gzip.NewReader(bytes.NewReader(rec.Body.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// No trailer yet, so expect an unexpected EOF after the data
+			data, _ := ioutil.ReadAll(reader)
+			flushed <- string(data)
+		}
+	})
+	r, _ := http.NewRequest("GET", "/test.txt", nil)
+	r.Header.Add("Accept-Encoding", "gzip")
+	CompressWithOptions(h, CompressOptions{MinSize: 1024}).ServeHTTP(rec, r)
+	assert200(t, r, rec)
+	for _, expected := range []string{"hello ", "hello world"} {
+		if data := <-flushed; data != expected {
+			t.Errorf("Unexpected data after flush: %q, expected: %q", data, expected)
+		}
+	}
+	if body := decode(t, rec); body != "hello world" {
+		t.Errorf("Unexpected response decompressed: %q, expected: 'hello world'", body)
+	}
+}
+
+func TestCompressEventStream(t *testing.T) {
+	enc := compressedWith(t, Compress(testHandlerType("text/event-stream", "data: test\n\n")))
+	if enc != "" {
+		t.Errorf("Event stream unexpectedly encoded as %q", enc)
+	}
+}
+
+type failingWriter struct {
+	http.ResponseWriter
+}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+// Errors that handlers may never see, like those writing the gzip trailer, end
+// up at the error handler
+func TestCompressErrors(t *testing.T) {
+	var reported []string
+	defer func(eh ErrorHandler) { DefaultErrorHandler = eh }(DefaultErrorHandler)
+	DefaultErrorHandler = ErrorHandlerFunc(func(r *http.Request, err error) {
+		reported = append(reported, err.Error())
+	})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("test"))
+		w.Write([]byte("test"))
+	})
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/test.txt", nil)
+	r.Header.Add("Accept-Encoding", "gzip")
+	Compress(h).ServeHTTP(failingWriter{rec}, r)
+	// Only the first write error is reported
+	expected := []string{"write: write failed", "close: write failed"}
+	if strings.Join(reported, "; ") != strings.Join(expected, "; ") {
+		t.Errorf("Unexpected errors reported: %q, expected: %q", reported, expected)
+	}
+}
+
+func TestCompressHead(t *testing.T) {
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("HEAD", "/test.txt", nil)
+	r.Header.Add("Accept-Encoding", "gzip")
+	Compress(Mimetype(testHandlerSimple)).ServeHTTP(rec, r)
+	assert200(t, r, rec)
+	if enc := rec.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Errorf("HEAD response encoded as %q, expected: gzip", enc)
+	}
+}
+
+// HEAD gets the headers GET would get, MinSize included
+func TestCompressHeadMinSize(t *testing.T) {
+	opts := CompressOptions{MinSize: 10}
+	for body, expected := range map[string]string{
+		"test":                    "",
+		strings.Repeat("test", 5): "gzip",
+	} {
+		for _, method := range []string{"GET", "HEAD"} {
+			rec := httptest.NewRecorder()
+			r, _ := http.NewRequest(method, "/test.txt", nil)
+			r.Header.Add("Accept-Encoding", "gzip")
+			CompressWithOptions(Mimetype(testHandlerType("text/plain", body)), opts).ServeHTTP(rec, r)
+			if enc := rec.Header().Get("Content-Encoding"); enc != expected {
+				t.Errorf("%s of %d bytes encoded as %q, expected: %q", method, len(body), enc, expected)
+			}
+		}
+	}
+}
+
+// A HEAD handler that writes no body gives no hint of the size of the GET
+func TestCompressHeadNoBody(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if r.Method == "GET" {
+			fmt.Fprint(w, strings.Repeat("test", 5))
+		}
+	})
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("HEAD", "/test.txt", nil)
+	r.Header.Add("Accept-Encoding", "gzip")
+	CompressWithOptions(h, CompressOptions{MinSize: 10}).ServeHTTP(rec, r)
+	if enc := rec.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Errorf("Bodiless HEAD encoded as %q, expected: gzip", enc)
+	}
+}
+
+func TestCompressBodiless(t *testing.T) {
+	for _, status := range []int{http.StatusNoContent, http.StatusNotModified} {
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(status)
+			// Invalid, but should not trip up Compress either
+			w.Write(nil)
+		})
+		rec := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/test.txt", nil)
+		r.Header.Add("Accept-Encoding", "gzip")
+		Compress(h).ServeHTTP(rec, r)
+		if rec.Code != status {
+			t.Fatalf("Unexpected status code: %d, expected: %d", rec.Code, status)
+		}
+		if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+			t.Errorf("%d response encoded as %q", status, enc)
+		}
+		if rec.Body.Len() != 0 {
+			t.Errorf("%d response has a body: %q", status, rec.Body.Bytes())
+		}
+	}
+}
+
+// An explicit WriteHeader before the body must not prevent wrappers from
+// changing headers
+func TestExplicitWriteHeader(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "test")
+	})
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/test.txt", nil)
+	r.Header.Add("Accept-Encoding", "gzip")
+	Compress(Mimetype(h)).ServeHTTP(rec, r)
+	assert200(t, r, rec)
+	head := rec.Result().Header
+	if ct := head.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("Unexpected Content-Type sent: %q", ct)
+	}
+	if enc := head.Get("Content-Encoding"); enc != "gzip" {
+		t.Errorf("Unexpected Content-Encoding sent: %q, expected: gzip", enc)
+	}
+	if body := decode(t, rec); body != "test" {
+		t.Errorf("Unexpected response decompressed: %q, expected: 'test'", body)
+	}
+}
@@ -22,58 +22,448 @@
 package godspeed
 
 import (
+	"bufio"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 )
 
-type bodyWrapperFactory func(http.ResponseWriter) io.Writer
+// What the body writer factory passed to WrapResponse gets to know about the
+// response
+type ResponseInfo struct {
+	// Where the (transformed) body goes. Headers can still be changed, and the
+	// status code with WriteHeader, until the first write to it.
+	ResponseWriter http.ResponseWriter
+	Request        *http.Request
+	// As set by the handler, 200 if it did not set one
+	Status int
+}
+
+func (ri ResponseInfo) Header() http.Header {
+	return ri.ResponseWriter.Header()
+}
+
+// Implemented by body writers that buffer, like gzip.Writer
+type flusher interface {
+	Flush() error
+}
+
+// The response writer handed to the body writer factory. It holds back the
+// status code until the first write (or flush), so body writers can still
+// change headers until they actually produce output. E.g.: Compress only
+// decides to set Content-Encoding once it has seen enough of the body.
+type pendingHeader struct {
+	http.ResponseWriter
+	bw        *bodyWrapper
+	status    int
+	committed bool
+}
+
+func (p *pendingHeader) WriteHeader(s int) {
+	if !p.committed {
+		p.status = s
+	}
+}
+
+func (p *pendingHeader) commit() {
+	if !p.committed {
+		p.committed = true
+		p.bw.sent(p.status)
+		p.ResponseWriter.WriteHeader(p.status)
+	}
+}
+
+func (p *pendingHeader) Write(data []byte) (int, error) {
+	p.commit()
+	n, err := p.ResponseWriter.Write(data)
+	p.bw.wrote(n, true)
+	return n, err
+}
 
 type bodyWrapper struct {
-	respw http.ResponseWriter
-	w     io.Writer
-	// Called after the wrapper handler has done its Head business
-	posthandler bodyWrapperFactory
+	respw   http.ResponseWriter
+	req     *http.Request
+	pending *pendingHeader
+	w       io.Writer
+	// Status code as set by the handler
+	status int
+	// Called after the wrapped handler has done its Head business
+	posthandler func(ResponseInfo) io.Writer
+	// First write error, reported only once
+	werr     error
+	closed   bool
+	hijacked bool
+	// Shared with all wrappers around the same response. The outermost one
+	// owns it.
+	stats *Stats
+	owner bool
 }
 
 func (w *bodyWrapper) Header() http.Header {
 	return w.respw.Header()
 }
 
-func (w *bodyWrapper) Write(data []byte) (int, error) {
+// Run the body writer factory, once
+func (w *bodyWrapper) open() {
+	if w.w != nil {
+		return
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.pending = &pendingHeader{ResponseWriter: w.respw, bw: w, status: w.status}
+	if w.posthandler != nil {
+		w.w = w.posthandler(ResponseInfo{
+			ResponseWriter: w.pending,
+			Request:        w.req,
+			Status:         w.status,
+		})
+	}
 	if w.w == nil {
-		w.w = w.posthandler(w.respw)
+		w.w = w.pending
 	}
-	return w.w.Write(data)
+}
+
+func (w *bodyWrapper) Write(data []byte) (int, error) {
+	w.open()
+	n, err := w.w.Write(data)
+	w.wrote(n, false)
+	// Like net/http, empty writes are not worth complaining about, e.g. on
+	// a status without body
+	if err != nil && w.werr == nil && len(data) > 0 {
+		w.werr = err
+		reportError(w.req, fmt.Errorf("write: %w", err))
+	}
+	return n, err
 }
 
 func (w *bodyWrapper) WriteHeader(s int) {
-	w.respw.WriteHeader(s)
+	if s < 200 {
+		// Informational responses are followed by the real one
+		w.respw.WriteHeader(s)
+		return
+	}
+	if w.w != nil {
+		// Too late, like a second call to WriteHeader on any ResponseWriter
+		return
+	}
+	w.status = s
+	w.open()
 }
 
+// Flushing commits the headers, so this runs the body writer factory if that
+// has not happened yet. Then the body writer is flushed, if it buffers,
+// followed by the underlying response writer.
+func (w *bodyWrapper) FlushError() error {
+	w.open()
+	if f, ok := w.w.(flusher); ok {
+		if err := f.Flush(); err != nil {
+			err = fmt.Errorf("flush: %w", err)
+			reportError(w.req, err)
+			return err
+		}
+	}
+	w.pending.commit()
+	return http.NewResponseController(w.respw).Flush()
+}
+
+func (w *bodyWrapper) Flush() {
+	w.FlushError()
+}
+
+// Without a transforming body writer, the underlying ReadFrom is used so
+// sendfile(2) and the like still work. A body writer that is an io.ReaderFrom
+// itself gets the source, e.g. to seek in it. Otherwise it is a plain copy.
+func (w *bodyWrapper) ReadFrom(src io.Reader) (int64, error) {
+	w.open()
+	var n int64
+	var err error
+	if rf, ok := w.respw.(io.ReaderFrom); ok && w.w == io.Writer(w.pending) {
+		w.pending.commit()
+		n, err = rf.ReadFrom(src)
+		w.wrote(int(n), false)
+		w.wrote(int(n), true)
+	} else if rf, ok := w.w.(io.ReaderFrom); ok && w.w != io.Writer(w.pending) {
+		n, err = rf.ReadFrom(src)
+		w.wrote(int(n), false)
+	} else {
+		// Hide our own ReadFrom from io.Copy
+		return io.Copy(struct{ io.Writer }{w}, src)
+	}
+	if err != nil && w.werr == nil {
+		w.werr = err
+		reportError(w.req, fmt.Errorf("write: %w", err))
+	}
+	return n, err
+}
+
+// For http.ResponseController
+func (w *bodyWrapper) Unwrap() http.ResponseWriter {
+	return w.respw
+}
+
+// After a successful hijack the wrapper stays out of the way: Close will not
+// touch the connection.
+func (w *bodyWrapper) hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.respw.(http.Hijacker).Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+func (w *bodyWrapper) push(target string, opts *http.PushOptions) error {
+	return w.respw.(http.Pusher).Push(target, opts)
+}
+
+// Finish the response: run the body writer factory if the handler did not write
+// anything, close the body writer and send the headers if that has not
+// happened yet. Errors are reported as well as returned. Only the first call
+// has any effect.
 func (w *bodyWrapper) Close() error {
+	if w.closed || w.hijacked {
+		return nil
+	}
+	w.closed = true
+	w.open()
 	var err error
-	if c, ok := w.w.(io.Closer); ok {
-		err = c.Close()
+	// The pending header writer itself is not ours to close
+	if c, ok := w.w.(io.Closer); ok && w.w != io.Writer(w.pending) {
+		if err = c.Close(); err != nil {
+			err = fmt.Errorf("close: %w", err)
+			reportError(w.req, err)
+		}
+	}
+	w.pending.commit()
+	if w.owner {
+		w.stats.Duration = time.Since(w.stats.Start)
 	}
 	return err
 }
 
-// Wrap response body in a different writer. This writer is generated by a
-// factory function once all headers have been written by the handler operating
-// on this ResponseWriter (i.e.: just before the first call to Write()). This
-// allows wrappers to determine action based on response headers generated by
-// whatever handler is operating. E.g.: the compression wrapper wants to know
-// the content-type header before it decides whether to wrap the body in a
-// compression writer at all.
+// Record n bytes written by the handler, or sent to the underlying writer
+func (w *bodyWrapper) wrote(n int, sent bool) {
+	switch {
+	case sent && w.owner:
+		w.stats.SentBytes += int64(n)
+	case !sent && w.stats.inner == w:
+		w.stats.BodyBytes += int64(n)
+	}
+}
+
+// Record the headers being sent with this status code
+func (w *bodyWrapper) sent(status int) {
+	if w.owner {
+		w.stats.Status = status
+		w.stats.FirstByte = time.Since(w.stats.Start)
+	}
+}
+
+func (w *bodyWrapper) getStats() *Stats {
+	return w.stats
+}
+
+// Wrap response body in a different writer, for middleware that needs to see
+// or change the response after the handler is done with the headers. This
+// writer is generated by a factory function once all headers have been written
+// by the handler operating on this ResponseWriter: just before the first call
+// to Write() or WriteHeader(), or when the wrapper is closed if neither ever
+// happens. This allows wrappers to determine action based on response headers
+// generated by whatever handler is operating. E.g.: the compression wrapper
+// wants to know the content-type header before it decides whether to wrap the
+// body in a compression writer at all.
 //
 // At the same time this allows the generators to change the headers after the
 // real handler. E.g.: the mime-type handler that guesses a content-type based
 // on the request path, but only if no custom content-type header has been set
 // by the application. These wrapper generators just return the original
-// response writer as the "new" body writer.
-func wrapBody(respw http.ResponseWriter, writerGen bodyWrapperFactory) *bodyWrapper {
-	return &bodyWrapper{
-		respw:       respw,
-		posthandler: writerGen,
+// response writer as the "new" body writer (or nil, which means the same).
+// A nil factory leaves the body alone altogether, which is still useful to
+// measure the response (see ResponseStats).
+//
+// The factory is called exactly once. The wrapper must be closed once the
+// handler is done with it, which closes the body writer if that is an
+// io.Closer and sends the headers if nothing else did. Only the first Close
+// has any effect. Errors writing, flushing and closing are returned to the
+// caller and reported to DefaultErrorHandler.
+//
+// The wrapper is an http.Hijacker and http.Pusher only if the underlying
+// response writer is. It can always Flush and ReadFrom, if need be without
+// help from the underlying writer or the body writer. After a successful
+// Hijack, Close does nothing.
+func WrapResponse(w http.ResponseWriter, r *http.Request, f func(ResponseInfo) io.Writer) ResponseWrapper {
+	bw := &bodyWrapper{
+		respw:       w,
+		req:         r,
+		posthandler: f,
+		stats:       ResponseStats(w),
+	}
+	if bw.stats == nil {
+		bw.stats = &Stats{Start: time.Now()}
+		bw.owner = true
+	}
+	// Wrappers are created from the outside in
+	bw.stats.inner = bw
+	_, hj := w.(http.Hijacker)
+	_, p := w.(http.Pusher)
+	switch {
+	case hj && p:
+		return hijackPushWrapper{bw}
+	case hj:
+		return hijackWrapper{bw}
+	case p:
+		return pushWrapper{bw}
 	}
+	return bw
+}
+
+// Measurements of a response, shared by all wrappers around it
+type Stats struct {
+	// Status code sent, 0 until the headers are sent
+	Status int
+	// Body as written by the handler, before any encoding
+	BodyBytes int64
+	// Body as sent to the client, after encoding
+	SentBytes int64
+	// When the outermost wrapper was created
+	Start time.Time
+	// Time to first byte: until the headers were sent
+	FirstByte time.Duration
+	// Until the outermost wrapper was closed
+	Duration time.Duration
+	// Innermost wrapper, the one the handler writes to
+	inner *bodyWrapper
+}
+
+// Stats of the response written through w, as measured by the ResponseWrapper
+// it is or wraps, if any. Otherwise nil. It is live: reading it after the
+// response is complete gives the final numbers.
+func ResponseStats(w http.ResponseWriter) *Stats {
+	for {
+		if s, ok := w.(interface{ getStats() *Stats }); ok {
+			return s.getStats()
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = u.Unwrap()
+	}
+}
+
+// What WrapResponse returns
+type ResponseWrapper interface {
+	http.ResponseWriter
+	http.Flusher
+	io.ReaderFrom
+	io.Closer
+	// The response writer being wrapped, for http.ResponseController
+	Unwrap() http.ResponseWriter
+}
+
+// A bodyWrapper is also a Hijacker and/or Pusher if the underlying writer is.
+// Each combination has its own type so type assertions by handlers tell the
+// truth.
+
+type hijackWrapper struct{ *bodyWrapper }
+
+func (w hijackWrapper) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.hijack()
+}
+
+type pushWrapper struct{ *bodyWrapper }
+
+func (w pushWrapper) Push(target string, opts *http.PushOptions) error {
+	return w.push(target, opts)
+}
+
+type hijackPushWrapper struct{ *bodyWrapper }
+
+func (w hijackPushWrapper) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.hijack()
+}
+
+func (w hijackPushWrapper) Push(target string, opts *http.PushOptions) error {
+	return w.push(target, opts)
+}
+
+// Holds back the first n bytes of a body, then lets decide pick the writer
+// those and the rest of the body go to. That happens as soon as n bytes have
+// been written, or earlier when the body is flushed or closed. The done
+// argument tells whether the whole body is in.
+type prefixGate struct {
+	n      int
+	buf    []byte
+	decide func(prefix []byte, done bool) io.Writer
+	w      io.Writer
+}
+
+func (g *prefixGate) Write(data []byte) (int, error) {
+	if g.w != nil {
+		return g.w.Write(data)
+	}
+	g.buf = append(g.buf, data...)
+	if len(g.buf) < g.n {
+		return len(data), nil
+	}
+	if err := g.start(false); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Stop buffering: pick the real writer and pass it what was held back
+func (g *prefixGate) start(done bool) error {
+	g.w = g.decide(g.buf, done)
+	buf := g.buf
+	g.buf = nil
+	_, err := g.w.Write(buf)
+	return err
+}
+
+// Flushing means the rest of the body is not worth waiting for
+func (g *prefixGate) Flush() error {
+	if g.w == nil {
+		if err := g.start(false); err != nil {
+			return err
+		}
+	}
+	if f, ok := g.w.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func (g *prefixGate) Close() error {
+	if g.w == nil {
+		if err := g.start(true); err != nil {
+			return err
+		}
+	}
+	if c, ok := g.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Add a field name to the Vary header unless it is already listed
+func addVary(head http.Header, field string) {
+	for _, v := range head.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			f = strings.TrimSpace(f)
+			if f == "*" || strings.EqualFold(f, field) {
+				return
+			}
+		}
+	}
+	head.Add("Vary", field)
+}
+
+// Whether a response with this status code can have a body
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent &&
+		status != http.StatusNotModified
 }
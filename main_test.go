@@ -0,0 +1,266 @@
+// Copyright © 2013 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package godspeed
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Underlying response writers with every combination of optional interfaces
+
+type testRecorder struct {
+	*httptest.ResponseRecorder
+	headersSent int
+	hijacked    bool
+	pushed      []string
+	readFrom    bool
+}
+
+func (w *testRecorder) WriteHeader(s int) {
+	w.headersSent++
+	w.ResponseRecorder.WriteHeader(s)
+}
+
+func (w *testRecorder) ReadFrom(src io.Reader) (int64, error) {
+	w.readFrom = true
+	return io.Copy(w.ResponseRecorder, src)
+}
+
+type testHijacker struct{ *testRecorder }
+
+func (w testHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+type testPusher struct{ *testRecorder }
+
+func (w testPusher) Push(target string, opts *http.PushOptions) error {
+	w.pushed = append(w.pushed, target)
+	return nil
+}
+
+type testHijackPusher struct{ *testRecorder }
+
+func (w testHijackPusher) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return testHijacker{w.testRecorder}.Hijack()
+}
+
+func (w testHijackPusher) Push(target string, opts *http.PushOptions) error {
+	return testPusher{w.testRecorder}.Push(target, opts)
+}
+
+func testWriters() []http.ResponseWriter {
+	rec := func() *testRecorder {
+		return &testRecorder{ResponseRecorder: httptest.NewRecorder()}
+	}
+	return []http.ResponseWriter{
+		rec(),
+		testHijacker{rec()},
+		testPusher{rec()},
+		testHijackPusher{rec()},
+	}
+}
+
+func recorderOf(w http.ResponseWriter) *testRecorder {
+	switch w := w.(type) {
+	case *testRecorder:
+		return w
+	case testHijacker:
+		return w.testRecorder
+	case testPusher:
+		return w.testRecorder
+	case testHijackPusher:
+		return w.testRecorder
+	}
+	panic("not a test writer")
+}
+
+func TestOptionalInterfaces(t *testing.T) {
+	for _, under := range testWriters() {
+		_, canHijack := under.(http.Hijacker)
+		_, canPush := under.(http.Pusher)
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := w.(http.Hijacker); ok != canHijack {
+				t.Errorf("%T: Hijacker %v, expected: %v", under, ok, canHijack)
+			}
+			if p, ok := w.(http.Pusher); ok != canPush {
+				t.Errorf("%T: Pusher %v, expected: %v", under, ok, canPush)
+			} else if ok {
+				p.Push("/style.css", nil)
+			}
+			if _, ok := w.(http.Flusher); !ok {
+				t.Errorf("%T: not a Flusher", under)
+			}
+			if _, ok := w.(io.ReaderFrom); !ok {
+				t.Errorf("%T: not a ReaderFrom", under)
+			}
+			err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+			if !errors.Is(err, http.ErrNotSupported) {
+				t.Errorf("%T: unexpected SetWriteDeadline result: %v", under, err)
+			}
+		})
+		r, _ := http.NewRequest("GET", "/test.txt", nil)
+		// Two layers deep
+		Mimetype(XFrameOptions(h)).ServeHTTP(under, r)
+		if rec := recorderOf(under); canPush && len(rec.pushed) != 1 {
+			t.Errorf("%T: push not passed on", under)
+		}
+	}
+}
+
+func TestHijack(t *testing.T) {
+	under := testHijacker{&testRecorder{ResponseRecorder: httptest.NewRecorder()}}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NewResponseController(w).Hijack()
+	})
+	r, _ := http.NewRequest("GET", "/test.txt", nil)
+	Compress(XFrameOptions(h)).ServeHTTP(under, r)
+	if !under.hijacked {
+		t.Fatal("Hijack not passed on")
+	}
+	if under.headersSent != 0 {
+		t.Errorf("Headers sent on hijacked connection")
+	}
+}
+
+// Uncompressed responses reach the ReadFrom of the underlying writer
+func TestReadFrom(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		under := &testRecorder{ResponseRecorder: httptest.NewRecorder()}
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Hide WriteTo, or io.Copy will not use ReadFrom
+			io.Copy(w, struct{ io.Reader }{strings.NewReader("test")})
+		})
+		r, _ := http.NewRequest("GET", "/test.txt", nil)
+		if compress {
+			r.Header.Set("Accept-Encoding", "gzip")
+		}
+		Compress(Mimetype(h)).ServeHTTP(under, r)
+		if under.readFrom == compress {
+			t.Errorf("Underlying ReadFrom used: %v, expected: %v",
+				under.readFrom, !compress)
+		}
+		if body := decode(t, under.ResponseRecorder); body != "test" {
+			t.Errorf("Unexpected response: %q, expected: 'test'", body)
+		}
+	}
+}
+
+// Counts bytes on their way through, and how often it is closed
+type countingWriter struct {
+	io.Writer
+	n      int
+	closed int
+}
+
+func (c *countingWriter) Write(data []byte) (int, error) {
+	c.n += len(data)
+	return c.Writer.Write(data)
+}
+
+func (c *countingWriter) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestWrapResponse(t *testing.T) {
+	var calls int
+	var info ResponseInfo
+	var cw *countingWriter
+	mw := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rw := WrapResponse(w, r, func(ri ResponseInfo) io.Writer {
+				calls++
+				info = ri
+				ri.Header().Set("X-Wrapped", "1")
+				cw = &countingWriter{Writer: ri.ResponseWriter}
+				return cw
+			})
+			h.ServeHTTP(rw, r)
+			rw.Close()
+			rw.Close()
+		})
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("te"))
+		w.Write([]byte("st"))
+	})
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/test.txt", nil)
+	mw(h).ServeHTTP(rec, r)
+	if calls != 1 {
+		t.Errorf("Factory called %d times, expected: once", calls)
+	}
+	if info.Status != http.StatusCreated || info.Request != r {
+		t.Errorf("Unexpected response info: %+v", info)
+	}
+	if rec.Code != http.StatusCreated || rec.Result().Header.Get("X-Wrapped") != "1" {
+		t.Errorf("Status or headers lost: %d %v", rec.Code, rec.Result().Header)
+	}
+	if cw.n != 4 || cw.closed != 1 {
+		t.Errorf("Body writer saw %d bytes and %d closes, expected: 4 and 1",
+			cw.n, cw.closed)
+	}
+}
+
+func TestResponseStats(t *testing.T) {
+	var stats *Stats
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats = ResponseStats(w)
+		for i := 0; i < 100; i++ {
+			io.WriteString(w, "test")
+		}
+	})
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/test.txt", nil)
+	r.Header.Add("Accept-Encoding", "gzip")
+	Compress(Mimetype(XFrameOptions(h))).ServeHTTP(rec, r)
+	if stats == nil {
+		t.Fatal("No stats for wrapped response")
+	}
+	if stats.Status != 200 {
+		t.Errorf("Unexpected status: %d, expected: 200", stats.Status)
+	}
+	if stats.BodyBytes != 400 {
+		t.Errorf("Unexpected body size: %d, expected: 400", stats.BodyBytes)
+	}
+	if stats.SentBytes != int64(rec.Body.Len()) {
+		t.Errorf("Unexpected sent size: %d, expected: %d",
+			stats.SentBytes, rec.Body.Len())
+	}
+	if stats.Duration <= 0 || stats.FirstByte > stats.Duration {
+		t.Errorf("Unexpected timing: first byte after %v, done after %v",
+			stats.FirstByte, stats.Duration)
+	}
+	if ResponseStats(rec) != nil {
+		t.Errorf("Stats for unwrapped response writer")
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright © 2013 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package godspeed
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Types known to every registry made by NewMimeRegistry. Fixed here rather
+// than taken from the host so lookups don't differ between machines.
+var builtinTypes = map[string]string{
+	".html":        "text/html; charset=utf-8",
+	".htm":         "text/html; charset=utf-8",
+	".css":         "text/css; charset=utf-8",
+	".js":          "text/javascript; charset=utf-8",
+	".mjs":         "text/javascript; charset=utf-8",
+	".cjs":         "text/javascript; charset=utf-8",
+	".json":        "application/json",
+	".map":         "application/json",
+	".webmanifest": "application/manifest+json",
+	".xml":         "text/xml; charset=utf-8",
+	".txt":         "text/plain; charset=utf-8",
+	".md":          "text/markdown; charset=utf-8",
+	".csv":         "text/csv; charset=utf-8",
+	".ics":         "text/calendar; charset=utf-8",
+	// Plain .ts stays an MPEG transport stream; only the unambiguous
+	// TypeScript suffixes are built in
+	".d.ts":   "text/typescript; charset=utf-8",
+	".mts":    "text/typescript; charset=utf-8",
+	".cts":    "text/typescript; charset=utf-8",
+	".ts":     "video/mp2t",
+	".svg":    "image/svg+xml",
+	".png":    "image/png",
+	".jpg":    "image/jpeg",
+	".jpeg":   "image/jpeg",
+	".gif":    "image/gif",
+	".webp":   "image/webp",
+	".avif":   "image/avif",
+	".ico":    "image/vnd.microsoft.icon",
+	".bmp":    "image/bmp",
+	".woff":   "font/woff",
+	".woff2":  "font/woff2",
+	".ttf":    "font/ttf",
+	".otf":    "font/otf",
+	".wasm":   "application/wasm",
+	".pdf":    "application/pdf",
+	".zip":    "application/zip",
+	".gz":     "application/gzip",
+	".tgz":    "application/gzip",
+	".tar":    "application/x-tar",
+	".tar.gz": "application/gzip",
+	".zst":    "application/zstd",
+	".mp3":    "audio/mpeg",
+	".ogg":    "audio/ogg",
+	".opus":   "audio/ogg",
+	".wav":    "audio/wav",
+	".mp4":    "video/mp4",
+	".webm":   "video/webm",
+}
+
+// Maps file name suffixes to mime-types. Suffixes may span several dots, as
+// in ".tar.gz" or ".d.ts"; the longest one that matches a name wins. Matching
+// is case-insensitive. The zero value is an empty registry, safe for
+// concurrent use.
+type MimeRegistry struct {
+	mu    sync.RWMutex
+	types map[string]string
+}
+
+// Registry used by Mimetype unless told otherwise
+var DefaultMimeRegistry = NewMimeRegistry()
+
+// A registry holding the built-in table
+func NewMimeRegistry() *MimeRegistry {
+	m := &MimeRegistry{types: make(map[string]string, len(builtinTypes))}
+	for ext, ctype := range builtinTypes {
+		m.types[ext] = ctype
+	}
+	return m
+}
+
+// Normalise an extension to the form used as map key: lower case with a
+// leading dot
+func extKey(ext string) string {
+	ext = strings.ToLower(ext)
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
+
+// Register a type for a suffix, replacing what was there. An empty type
+// removes the suffix.
+func (m *MimeRegistry) Set(ext, ctype string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ctype == "" {
+		delete(m.types, extKey(ext))
+		return
+	}
+	if m.types == nil {
+		m.types = map[string]string{}
+	}
+	m.types[extKey(ext)] = ctype
+}
+
+// Read types in mime.types format: a type followed by its extensions on each
+// line, with # comments. Entries override existing ones.
+func (m *MimeRegistry) Load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if !strings.Contains(fields[0], "/") {
+			return fmt.Errorf("line %d: invalid mime-type %q", n, fields[0])
+		}
+		for _, ext := range fields[1:] {
+			m.Set(ext, fields[0])
+		}
+	}
+	return scanner.Err()
+}
+
+// Load a mime.types file
+func (m *MimeRegistry) LoadFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := m.Load(f); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// Mime-type for the file name at the end of a path, "" if unknown
+func (m *MimeRegistry) TypeByPath(p string) string {
+	name := strings.ToLower(path.Base(p))
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	// Try suffixes from the first dot on, so longer ones come first. A
+	// leading dot marks a hidden file, not an extension.
+	for i := 1; i < len(name); i++ {
+		if name[i] != '.' {
+			continue
+		}
+		if ctype, ok := m.types[name[i:]]; ok {
+			return ctype
+		}
+	}
+	return ""
+}
@@ -0,0 +1,141 @@
+// Copyright © 2013 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package godspeed
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMimeRegistry(t *testing.T) {
+	reg := NewMimeRegistry()
+	for p, expected := range map[string]string{
+		"/index.html":           "text/html; charset=utf-8",
+		"/INDEX.HTML":           "text/html; charset=utf-8",
+		"/app.webmanifest":      "application/manifest+json",
+		"/dist/backup.tar.gz":   "application/gzip",
+		"/types/index.d.ts":     "text/typescript; charset=utf-8",
+		"/src/main.mts":         "text/typescript; charset=utf-8",
+		"/video/clip.ts":        "video/mp2t",
+		"/dir.with.dots/readme": "",
+		"/.htaccess":            "",
+		"/download":             "",
+	} {
+		if ctype := reg.TypeByPath(p); ctype != expected {
+			t.Errorf("Type for %q: %q, expected: %q", p, ctype, expected)
+		}
+	}
+}
+
+func TestMimeRegistryOverrides(t *testing.T) {
+	reg := NewMimeRegistry()
+	reg.Set("js", "application/javascript")
+	reg.Set(".source-map", "application/json")
+	reg.Set(".ts", "")
+	if ctype := reg.TypeByPath("/a.js"); ctype != "application/javascript" {
+		t.Errorf("Override ignored: %q", ctype)
+	}
+	if ctype := reg.TypeByPath("/a.source-map"); ctype != "application/json" {
+		t.Errorf("Hyphenated extension not found: %q", ctype)
+	}
+	if ctype := reg.TypeByPath("/a.ts"); ctype != "" {
+		t.Errorf("Removed extension still found: %q", ctype)
+	}
+	// Other registries are unaffected
+	if ctype := DefaultMimeRegistry.TypeByPath("/a.js"); ctype != "text/javascript; charset=utf-8" {
+		t.Errorf("Override leaked into default registry: %q", ctype)
+	}
+	var empty MimeRegistry
+	if ctype := empty.TypeByPath("/a.html"); ctype != "" {
+		t.Errorf("Zero registry not empty: %q", ctype)
+	}
+	empty.Set("html", "text/html")
+	if ctype := empty.TypeByPath("/a.html"); ctype != "text/html" {
+		t.Errorf("Set on zero registry: %q", ctype)
+	}
+}
+
+func TestMimeRegistryLoad(t *testing.T) {
+	reg := &MimeRegistry{}
+	err := reg.Load(strings.NewReader(`# comment
+application/x-custom	cst custom.gz
+text/x-foo		foo # trailing comment
+
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, expected := range map[string]string{
+		"/a.cst":       "application/x-custom",
+		"/a.custom.gz": "application/x-custom",
+		"/a.foo":       "text/x-foo",
+		"/a.gz":        "",
+	} {
+		if ctype := reg.TypeByPath(p); ctype != expected {
+			t.Errorf("Type for %q: %q, expected: %q", p, ctype, expected)
+		}
+	}
+	if err := reg.Load(strings.NewReader("nonsense ext\n")); err == nil {
+		t.Error("Expected error for invalid line")
+	}
+	name := filepath.Join(t.TempDir(), "mime.types")
+	if err := os.WriteFile(name, []byte("image/x-bar bar\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.LoadFile(name); err != nil {
+		t.Fatal(err)
+	}
+	if ctype := reg.TypeByPath("/a.bar"); ctype != "image/x-bar" {
+		t.Errorf("Type from file: %q", ctype)
+	}
+}
+
+func TestMimetypeRegistry(t *testing.T) {
+	reg := &MimeRegistry{}
+	reg.Set(".tar.gz", "application/x-gtar")
+	h := MimetypeWithOptions(testHandlerSimple, MimetypeOptions{Registry: reg})
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/dist/release.tar.gz", nil)
+	h.ServeHTTP(rec, r)
+	testContentType(t, r, rec, "application/x-gtar")
+	rec = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/index.html", nil)
+	h.ServeHTTP(rec, r)
+	if ct := rec.Header().Get("Content-Type"); ct != "" {
+		t.Errorf("Type from outside the registry: %q", ct)
+	}
+}
+
+// TypeScript sources are text, so they get compressed
+func TestMimetypeTypeScript(t *testing.T) {
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/types/index.d.ts", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	Compress(Mimetype(testHandlerSimple)).ServeHTTP(rec, r)
+	testContentType(t, r, rec, "text/typescript; charset=utf-8")
+	if enc := rec.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Errorf("TypeScript not compressed: %q", enc)
+	}
+}
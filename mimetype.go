@@ -24,24 +24,110 @@ import (
 	"io"
 	"mime"
 	"net/http"
-	"regexp"
+	"strings"
 )
 
-var findext = regexp.MustCompile(`\.\w+$`)
+// Signatures http.DetectContentType does not know about, checked first
+var magicTypes = []struct {
+	offset int
+	magic  string
+	ctype  string
+}{
+	{4, "ftypavif", "image/avif"},
+	{4, "ftypavis", "image/avif"},
+}
+
+// Guess a mime-type from the first bytes of a body. Unrecognised binary data
+// ends up as application/octet-stream.
+func sniffType(prefix []byte) string {
+	for _, m := range magicTypes {
+		if len(prefix) >= m.offset+len(m.magic) &&
+			string(prefix[m.offset:m.offset+len(m.magic)]) == m.magic {
+			return m.ctype
+		}
+	}
+	return http.DetectContentType(prefix)
+}
 
-// Best-effort guessing of mime-type based on extension of request path. Does
-// not override content-type if already set.
+// Number of body bytes held back for sniffing, same as net/http
+const sniffLen = 512
+
+type MimetypeOptions struct {
+	// Where to look up path extensions, DefaultMimeRegistry if nil
+	Registry *MimeRegistry
+	// Look at the start of the body when neither the handler nor the path
+	// extension gives a type. Holds back up to 512 bytes of the response
+	// until the type is known.
+	Sniff bool
+	// Charset added to textual types that lack one, e.g. "utf-8". Applies
+	// to text/*, JavaScript, JSON and XML types, whoever set them. Empty
+	// leaves types alone.
+	Charset string
+}
+
+// Types that carry text, and so a charset, besides text/*
+var charsetTypes = []string{
+	"application/javascript",
+	"application/json",
+	"+json",
+	"application/xml",
+	"+xml",
+}
+
+// Append a charset parameter to a textual type without one
+func withCharset(ctype, charset string) string {
+	mtype, params, err := mime.ParseMediaType(ctype)
+	if err != nil || params["charset"] != "" {
+		return ctype
+	}
+	if !strings.HasPrefix(mtype, "text/") && !matchType(mtype, charsetTypes) {
+		return ctype
+	}
+	return ctype + "; charset=" + charset
+}
+
+// Best-effort guessing of mime-type based on extension of request path, using
+// DefaultMimeRegistry. Does not override content-type if already set.
 func Mimetype(h http.Handler) http.Handler {
+	return MimetypeWithOptions(h, MimetypeOptions{})
+}
+
+// Like Mimetype, optionally falling back to content sniffing and adding a
+// default charset. Place it inside Compress so the sniffed type is set before
+// compression is decided on.
+func MimetypeWithOptions(h http.Handler, opts MimetypeOptions) http.Handler {
+	reg := opts.Registry
+	if reg == nil {
+		reg = DefaultMimeRegistry
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		f := func(w http.ResponseWriter) io.Writer {
-			if head := w.Header(); head.Get("Content-Type") == "" {
-				ext := findext.FindString(r.URL.Path)
-				if ctype := mime.TypeByExtension(ext); ctype != "" {
+		f := func(ri ResponseInfo) io.Writer {
+			w := ri.ResponseWriter
+			head := w.Header()
+			setCharset := func() {
+				if ctype := head.Get("Content-Type"); ctype != "" && opts.Charset != "" {
+					head.Set("Content-Type", withCharset(ctype, opts.Charset))
+				}
+			}
+			if head.Get("Content-Type") == "" {
+				if ctype := reg.TypeByPath(r.URL.Path); ctype != "" {
 					head.Set("Content-Type", ctype)
+				} else if opts.Sniff && bodyAllowed(ri.Status) && r.Method != "HEAD" &&
+					head.Get("Content-Encoding") == "" {
+					return &prefixGate{n: sniffLen, decide: func(prefix []byte, _ bool) io.Writer {
+						if len(prefix) > 0 {
+							head.Set("Content-Type", sniffType(prefix))
+							setCharset()
+						}
+						return w
+					}}
 				}
 			}
+			setCharset()
 			return w
 		}
-		h.ServeHTTP(wrapBody(w, f), r)
+		bw := WrapResponse(w, r, f)
+		h.ServeHTTP(bw, r)
+		bw.Close()
 	})
 }
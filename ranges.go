@@ -0,0 +1,351 @@
+// Copyright © 2013 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package godspeed
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// More parts than this and the Range header is ignored, rather than letting
+// clients make us send mostly multipart overhead
+const maxRanges = 32
+
+// Byte range, end exclusive
+type byteRange struct {
+	start, end int64
+}
+
+func (br byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.end-1, size)
+}
+
+var errInvalidRange = errors.New("invalid range")
+
+// Satisfiable ranges of a Range header for a body of the given size, sorted
+// and with overlaps merged. None at all means 416 Range Not Satisfiable. Errors
+// mean the header should be ignored.
+func parseRange(spec string, size int64) ([]byteRange, error) {
+	spec, ok := strings.CutPrefix(spec, "bytes=")
+	if !ok {
+		return nil, errInvalidRange
+	}
+	var ranges []byteRange
+	for _, rs := range strings.Split(spec, ",") {
+		rs = strings.TrimSpace(rs)
+		if rs == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(rs, "-")
+		if !ok {
+			return nil, errInvalidRange
+		}
+		var br byteRange
+		if first == "" {
+			// Suffix: the last n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errInvalidRange
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			br = byteRange{max(size-n, 0), size}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errInvalidRange
+			}
+			br = byteRange{start, size}
+			if last != "" {
+				end, err := strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, errInvalidRange
+				}
+				br.end = min(end+1, size)
+			}
+			if start >= size {
+				continue
+			}
+		}
+		ranges = append(ranges, br)
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+	var merged []byteRange
+	for _, br := range ranges {
+		if n := len(merged); n > 0 && br.start <= merged[n-1].end {
+			merged[n-1].end = max(merged[n-1].end, br.end)
+			continue
+		}
+		merged = append(merged, br)
+	}
+	return merged, nil
+}
+
+// Whether an If-Range header matches the validators of a response. Only
+// strong ETags and exact dates count.
+func ifRangeMatch(ir string, head http.Header) bool {
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		return etagMatch(ir, head.Get("ETag"), false)
+	}
+	t, err := http.ParseTime(ir)
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(head.Get("Last-Modified"))
+	return err == nil && modified.Truncate(time.Second).Equal(t)
+}
+
+// Passes on the parts of a body that fall within the ranges, as a single
+// range or as multipart/byteranges
+type rangeBody struct {
+	w      io.Writer
+	ranges []byteRange
+	size   int64
+	// Only for multipart responses
+	mw    *multipart.Writer
+	ctype string
+	// Offset of the next byte from the handler
+	pos int64
+	// Range being written, and where its bytes go once started
+	i    int
+	part io.Writer
+}
+
+func (b *rangeBody) partHeader(br byteRange) textproto.MIMEHeader {
+	h := textproto.MIMEHeader{}
+	if b.ctype != "" {
+		h.Set("Content-Type", b.ctype)
+	}
+	h.Set("Content-Range", br.contentRange(b.size))
+	return h
+}
+
+// Length of the whole multipart body
+func (b *rangeBody) multipartLength() int64 {
+	var c byteCounter
+	mw := multipart.NewWriter(&c)
+	mw.SetBoundary(b.mw.Boundary())
+	var n int64
+	for _, br := range b.ranges {
+		mw.CreatePart(b.partHeader(br))
+		n += br.end - br.start
+	}
+	mw.Close()
+	return n + int64(c)
+}
+
+func (b *rangeBody) startPart() error {
+	if b.mw == nil {
+		b.part = b.w
+		return nil
+	}
+	var err error
+	b.part, err = b.mw.CreatePart(b.partHeader(b.ranges[b.i]))
+	return err
+}
+
+func (b *rangeBody) Write(data []byte) (int, error) {
+	n := len(data)
+	for len(data) > 0 && b.i < len(b.ranges) {
+		br := b.ranges[b.i]
+		if b.pos < br.start {
+			skip := min(br.start-b.pos, int64(len(data)))
+			data = data[skip:]
+			b.pos += skip
+			continue
+		}
+		if b.part == nil {
+			if err := b.startPart(); err != nil {
+				return 0, err
+			}
+		}
+		m := min(br.end-b.pos, int64(len(data)))
+		if _, err := b.part.Write(data[:m]); err != nil {
+			return 0, err
+		}
+		data = data[m:]
+		b.pos += m
+		if b.pos == br.end {
+			b.i++
+			b.part = nil
+		}
+	}
+	b.pos += int64(len(data))
+	return n, nil
+}
+
+// A seekable source has the parts of the ranges it covers copied straight
+// from it, skipping the rest. The source is left at its end, and the handler
+// may write more after it.
+func (b *rangeBody) ReadFrom(src io.Reader) (int64, error) {
+	rs, ok := src.(io.ReadSeeker)
+	if !ok {
+		return io.Copy(struct{ io.Writer }{b}, src)
+	}
+	cur, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return io.Copy(struct{ io.Writer }{b}, src)
+	}
+	end, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	// The source holds body offsets b.pos up to stop
+	base := cur - b.pos
+	stop := b.pos + end - cur
+	for b.pos < stop && b.i < len(b.ranges) && b.ranges[b.i].start < stop {
+		br := b.ranges[b.i]
+		b.pos = max(b.pos, br.start)
+		if b.part == nil {
+			if err := b.startPart(); err != nil {
+				return 0, err
+			}
+		}
+		if _, err := rs.Seek(base+b.pos, io.SeekStart); err != nil {
+			return 0, err
+		}
+		m := min(br.end, stop) - b.pos
+		if _, err := io.CopyN(b.part, rs, m); err != nil {
+			return 0, err
+		}
+		b.pos += m
+		if b.pos == br.end {
+			b.i++
+			b.part = nil
+		}
+	}
+	b.pos = stop
+	if _, err := rs.Seek(end, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return end - cur, nil
+}
+
+func (b *rangeBody) Close() error {
+	if b.mw != nil {
+		return b.mw.Close()
+	}
+	return nil
+}
+
+type byteCounter int64
+
+func (c *byteCounter) Write(data []byte) (int, error) {
+	*c += byteCounter(len(data))
+	return len(data), nil
+}
+
+type RangesOptions struct {
+	// Largest body of unknown length held back to find its length, 1 MiB if
+	// 0. Bigger bodies are sent whole.
+	MaxSize int
+}
+
+// Serve byte ranges of 200 responses to GET requests, as a single range or
+// multipart/byteranges, and advertise that with Accept-Ranges. Honours
+// If-Range. The length of the body comes from Content-Length; otherwise the
+// body is held back, up to 1 MiB. With a Content-Length, seekable sources
+// passed to ReadFrom (as io.Copy does) are seeked in rather than read whole.
+// Overlapping ranges are merged, and parts are sent in ascending order.
+//
+// Ranges apply to the encoded body, so responses with a Content-Encoding are
+// left alone. Put Ranges outside Compress: a compressed response is then sent
+// whole, and an uncompressed one can be served in ranges.
+func Ranges(h http.Handler) http.Handler {
+	return RangesWithOptions(h, RangesOptions{})
+}
+
+// Same as Ranges, with a different limit on held back bodies
+func RangesWithOptions(h http.Handler, opts RangesOptions) http.Handler {
+	maxSize := opts.MaxSize
+	if maxSize <= 0 {
+		maxSize = 1 << 20
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f := func(ri ResponseInfo) io.Writer {
+			w := ri.ResponseWriter
+			head := w.Header()
+			if ri.Status != http.StatusOK || head.Get("Content-Encoding") != "" {
+				return w
+			}
+			if r.Method != "GET" && r.Method != "HEAD" {
+				return w
+			}
+			head.Set("Accept-Ranges", "bytes")
+			spec := r.Header.Get("Range")
+			if r.Method != "GET" || spec == "" {
+				return w
+			}
+			if ir := r.Header.Get("If-Range"); ir != "" && !ifRangeMatch(ir, head) {
+				return w
+			}
+			serve := func(size int64) io.Writer {
+				ranges, err := parseRange(spec, size)
+				if err != nil || len(ranges) > maxRanges {
+					return w
+				}
+				if len(ranges) == 0 {
+					head.Del("Content-Type")
+					head.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+					head.Set("Content-Length", "0")
+					w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+					return io.Discard
+				}
+				b := &rangeBody{w: w, ranges: ranges, size: size}
+				length := ranges[0].end - ranges[0].start
+				if len(ranges) == 1 {
+					head.Set("Content-Range", ranges[0].contentRange(size))
+				} else {
+					b.mw = multipart.NewWriter(w)
+					b.ctype = head.Get("Content-Type")
+					head.Set("Content-Type", "multipart/byteranges; boundary="+b.mw.Boundary())
+					length = b.multipartLength()
+				}
+				head.Set("Content-Length", strconv.FormatInt(length, 10))
+				w.WriteHeader(http.StatusPartialContent)
+				return b
+			}
+			if size, err := strconv.ParseInt(head.Get("Content-Length"), 10, 64); err == nil && size >= 0 {
+				return serve(size)
+			}
+			return &prefixGate{n: maxSize + 1, decide: func(body []byte, done bool) io.Writer {
+				if !done {
+					return w
+				}
+				return serve(int64(len(body)))
+			}}
+		}
+		bw := WrapResponse(w, r, f)
+		h.ServeHTTP(bw, r)
+		bw.Close()
+	})
+}
@@ -0,0 +1,226 @@
+// Copyright © 2013 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package godspeed
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const rangeBodyText = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+// Serves rangeBodyText, with or without Content-Length
+func rangeHandler(withLength bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("ETag", `"v1"`)
+		if withLength {
+			w.Header().Set("Content-Length", strconv.Itoa(len(rangeBodyText)))
+		}
+		// In pieces, so ranges straddle writes
+		for i := 0; i < len(rangeBodyText); i += 5 {
+			io.WriteString(w, rangeBodyText[i:min(i+5, len(rangeBodyText))])
+		}
+	})
+}
+
+func rangeRequest(h http.Handler, head map[string]string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/file", nil)
+	for k, v := range head {
+		r.Header.Set(k, v)
+	}
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestRangesSingle(t *testing.T) {
+	for _, withLength := range []bool{true, false} {
+		h := Ranges(rangeHandler(withLength))
+		for spec, expected := range map[string]string{
+			"bytes=0-4":     "01234",
+			"bytes=8-12":    "89abc",
+			"bytes=30-":     "uvwxyz",
+			"bytes=-3":      "xyz",
+			"bytes=30-1000": "uvwxyz",
+			"bytes=0-0,1-2": "012",
+		} {
+			rec := rangeRequest(h, map[string]string{"Range": spec})
+			if rec.Code != http.StatusPartialContent || rec.Body.String() != expected {
+				t.Errorf("%s: %d %q, expected: %q", spec, rec.Code, rec.Body.String(), expected)
+				continue
+			}
+			if cl := rec.Header().Get("Content-Length"); cl != strconv.Itoa(len(expected)) {
+				t.Errorf("%s: Content-Length %s", spec, cl)
+			}
+			if cr := rec.Header().Get("Content-Range"); !strings.HasSuffix(cr, "/36") {
+				t.Errorf("%s: Content-Range %q", spec, cr)
+			}
+		}
+		rec := rangeRequest(h, nil)
+		if rec.Code != 200 || rec.Body.String() != rangeBodyText || rec.Header().Get("Accept-Ranges") != "bytes" {
+			t.Errorf("Unexpected response without Range: %d %q", rec.Code, rec.Header())
+		}
+	}
+}
+
+func TestRangesMultipart(t *testing.T) {
+	rec := rangeRequest(Ranges(rangeHandler(false)), map[string]string{"Range": "bytes=-2, 0-1, 10-12"})
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("Unexpected status: %d", rec.Code)
+	}
+	if cl := rec.Header().Get("Content-Length"); cl != strconv.Itoa(rec.Body.Len()) {
+		t.Errorf("Content-Length %s for body of %d bytes", cl, rec.Body.Len())
+	}
+	mtype, params, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	if err != nil || mtype != "multipart/byteranges" {
+		t.Fatalf("Unexpected Content-Type: %q", rec.Header().Get("Content-Type"))
+	}
+	mr := multipart.NewReader(rec.Body, params["boundary"])
+	var parts []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(p)
+		parts = append(parts, fmt.Sprintf("%s|%s|%s", p.Header.Get("Content-Type"),
+			p.Header.Get("Content-Range"), data))
+	}
+	expected := []string{
+		"text/plain|bytes 0-1/36|01",
+		"text/plain|bytes 10-12/36|abc",
+		"text/plain|bytes 34-35/36|yz",
+	}
+	if fmt.Sprint(parts) != fmt.Sprint(expected) {
+		t.Errorf("Unexpected parts: %q, expected: %q", parts, expected)
+	}
+}
+
+func TestRangesInvalid(t *testing.T) {
+	h := Ranges(rangeHandler(true))
+	rec := rangeRequest(h, map[string]string{"Range": "bytes=100-"})
+	if rec.Code != http.StatusRequestedRangeNotSatisfiable || rec.Header().Get("Content-Range") != "bytes */36" {
+		t.Errorf("Unsatisfiable range: %d %q", rec.Code, rec.Header().Get("Content-Range"))
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("Body sent with 416: %q", rec.Body.String())
+	}
+	for _, spec := range []string{"bytes=5-1", "lines=1-2", "bytes=x-", "bytes=1"} {
+		rec := rangeRequest(h, map[string]string{"Range": spec})
+		if rec.Code != 200 || rec.Body.String() != rangeBodyText {
+			t.Errorf("Invalid range %q not ignored: %d", spec, rec.Code)
+		}
+	}
+}
+
+func TestRangesIfRange(t *testing.T) {
+	h := Ranges(rangeHandler(true))
+	for ir, status := range map[string]int{
+		`"v1"`:                          206,
+		`"v2"`:                          200,
+		`W/"v1"`:                        200,
+		"Sun, 06 Nov 1994 08:49:37 GMT": 200,
+	} {
+		rec := rangeRequest(h, map[string]string{"Range": "bytes=0-1", "If-Range": ir})
+		if rec.Code != status {
+			t.Errorf("If-Range %s: %d, expected: %d", ir, rec.Code, status)
+		}
+	}
+}
+
+// Ranges of compressed responses are not served, and Compress leaves ranges
+// alone
+func TestRangesCompress(t *testing.T) {
+	head := map[string]string{"Range": "bytes=0-4", "Accept-Encoding": "gzip"}
+	rec := rangeRequest(Ranges(Compress(rangeHandler(false))), head)
+	if rec.Code != 200 || rec.Header().Get("Content-Encoding") != "gzip" || rec.Header().Get("Accept-Ranges") != "" {
+		t.Errorf("Range of compressed response: %d %q", rec.Code, rec.Header())
+	}
+	rec = rangeRequest(Compress(Ranges(rangeHandler(false))), head)
+	if rec.Code != 206 || rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != "01234" {
+		t.Errorf("Partial response compressed: %d %q", rec.Code, rec.Header())
+	}
+}
+
+// Only reads what is needed, and tells how much there is to read
+type seekReader struct {
+	rs   io.ReadSeeker
+	read int
+}
+
+func (s *seekReader) Read(p []byte) (int, error) {
+	n, err := s.rs.Read(p)
+	s.read += n
+	return n, err
+}
+
+func (s *seekReader) Seek(offset int64, whence int) (int64, error) {
+	return s.rs.Seek(offset, whence)
+}
+
+func TestRangesSeeker(t *testing.T) {
+	// A prefix written before the source and more after it
+	body := "<<" + rangeBodyText + ">>"
+	for _, withLength := range []bool{true, false} {
+		src := &seekReader{rs: strings.NewReader(rangeBodyText)}
+		h := Ranges(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if withLength {
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			}
+			io.WriteString(w, "<<")
+			n, err := io.Copy(w, src)
+			if err != nil || n != int64(len(rangeBodyText)) {
+				t.Errorf("Copy: %d, %v", n, err)
+			}
+			io.WriteString(w, ">>")
+		}))
+		for spec, expected := range map[string]string{
+			"bytes=-3":  "z>>",
+			"bytes=0-3": "<<01",
+			"bytes=5-7": "345",
+			"bytes=38-": ">>",
+		} {
+			src.rs.Seek(0, io.SeekStart)
+			src.read = 0
+			rec := rangeRequest(h, map[string]string{"Range": spec})
+			if rec.Code != 206 || rec.Body.String() != expected {
+				t.Errorf("%s: %d %q, expected: %q", spec, rec.Code, rec.Body.String(), expected)
+			}
+			if cr := rec.Header().Get("Content-Range"); !strings.HasSuffix(cr, "/40") {
+				t.Errorf("%s: Content-Range %q", spec, cr)
+			}
+			if withLength && src.read > len(expected) {
+				t.Errorf("%s: read %d bytes from source, expected at most %d", spec, src.read, len(expected))
+			}
+		}
+	}
+}
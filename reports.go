@@ -0,0 +1,297 @@
+// Copyright © 2013 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package godspeed
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A violation report sent by a browser: CSP, COEP, NEL, ...
+type Report struct {
+	// As in the Reporting API: "csp-violation", "coep", "network-error", etc.
+	// Legacy CSP reports get "csp-violation".
+	Type string `json:"type"`
+	// Document the report is about
+	URL       string `json:"url"`
+	UserAgent string `json:"user_agent"`
+	// Milliseconds between the violation and sending the report
+	Age int64 `json:"age"`
+	// Details as sent by the browser. Their shape depends on the type, and
+	// legacy CSP reports use different names than the Reporting API.
+	Body map[string]any `json:"body"`
+}
+
+// Receives reports from ReportCollector
+type ReportSink interface {
+	HandleReport(Report)
+}
+
+// Adapter to use an ordinary function as ReportSink
+type ReportSinkFunc func(Report)
+
+func (f ReportSinkFunc) HandleReport(rep Report) {
+	f(rep)
+}
+
+// Log reports as warnings
+func SlogSink(l *slog.Logger) ReportSink {
+	return ReportSinkFunc(func(rep Report) {
+		l.LogAttrs(context.Background(), slog.LevelWarn, "security report",
+			slog.String("type", rep.Type),
+			slog.String("url", rep.URL),
+			slog.String("user_agent", rep.UserAgent),
+			slog.Int64("age", rep.Age),
+			slog.Any("body", rep.Body))
+	})
+}
+
+// Write reports as JSON, one per line
+func WriterSink(w io.Writer) ReportSink {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return ReportSinkFunc(func(rep Report) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := enc.Encode(rep); err != nil {
+			reportError(nil, err)
+		}
+	})
+}
+
+// Send reports to a channel. Reports are dropped when it is full, rather than
+// hold up the browser that sent them.
+func ChanSink(c chan<- Report) ReportSink {
+	return ReportSinkFunc(func(rep Report) {
+		select {
+		case c <- rep:
+		default:
+		}
+	})
+}
+
+// Settings for ReportCollector
+type ReportCollectorOptions struct {
+	// Largest request body accepted. Zero means 64 KiB.
+	MaxBody int64
+	// Identical reports within this period are passed on once. Zero means a
+	// minute, negative means no deduplication. At most 10000 reports are
+	// remembered.
+	DedupWindow time.Duration
+	// Reports passed on per second, on average, in bursts of at most Burst.
+	// Zero means no limit. Excess reports are dropped.
+	Rate  float64
+	Burst int
+}
+
+// Token bucket
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (l *rateLimiter) allow(now time.Time) bool {
+	if l.rate <= 0 {
+		return true
+	}
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// What makes reports the same violation. Age and user agent differ between
+// deliveries of the same thing.
+func (rep *Report) dedupKey() []byte {
+	// encoding/json sorts map keys, so this is canonical
+	key, _ := json.Marshal(struct {
+		Type string
+		URL  string
+		Body map[string]any
+	}{rep.Type, rep.URL, rep.Body})
+	return key
+}
+
+// Filters out reports that are duplicates or over the rate limit
+type reportFilter struct {
+	mu      sync.Mutex
+	window  time.Duration
+	seen    map[[sha256.Size]byte]time.Time
+	limiter rateLimiter
+}
+
+// Most reports remembered for deduplication. When full, the oldest is
+// forgotten.
+const maxSeenReports = 10000
+
+func (f *reportFilter) allow(rep *Report) bool {
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var key [sha256.Size]byte
+	if f.window > 0 {
+		key = sha256.Sum256(rep.dedupKey())
+		if t, ok := f.seen[key]; ok && now.Sub(t) < f.window {
+			return false
+		}
+	}
+	// Only reports that get through are remembered, so the rate limit
+	// bounds how fast the map can grow
+	if !f.limiter.allow(now) {
+		return false
+	}
+	if f.window > 0 {
+		if len(f.seen) >= maxSeenReports {
+			f.prune(now)
+		}
+		f.seen[key] = now
+	}
+	return true
+}
+
+// Forget expired reports, or the oldest one if none has
+func (f *reportFilter) prune(now time.Time) {
+	var oldest [sha256.Size]byte
+	var oldestTime time.Time
+	for k, t := range f.seen {
+		if now.Sub(t) >= f.window {
+			delete(f.seen, k)
+		} else if oldestTime.IsZero() || t.Before(oldestTime) {
+			oldest, oldestTime = k, t
+		}
+	}
+	if len(f.seen) >= maxSeenReports {
+		delete(f.seen, oldest)
+	}
+}
+
+// Parse a request body in either report format
+func parseReports(ctype string, data []byte) ([]Report, error) {
+	switch mediatype(ctype) {
+	case "application/reports+json":
+		var reps []Report
+		if err := json.Unmarshal(data, &reps); err != nil {
+			return nil, err
+		}
+		if reps == nil {
+			return nil, errMalformedReport
+		}
+		for _, rep := range reps {
+			if rep.Type == "" {
+				return nil, errMalformedReport
+			}
+		}
+		return reps, nil
+	case "application/csp-report", "application/json":
+		var legacy struct {
+			Report map[string]any `json:"csp-report"`
+		}
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return nil, err
+		}
+		if legacy.Report == nil {
+			return nil, errMalformedReport
+		}
+		rep := Report{Type: "csp-violation", Body: legacy.Report}
+		rep.URL, _ = legacy.Report["document-uri"].(string)
+		return []Report{rep}, nil
+	}
+	return nil, errUnsupportedReport
+}
+
+var (
+	errUnsupportedReport = errors.New("unsupported report format")
+	errMalformedReport   = errors.New("malformed report")
+)
+
+// Endpoint for browsers to POST violation reports to, as configured with e.g.
+// CSPPolicy.ReportURI or a Reporting-Endpoints header. Accepts both legacy
+// application/csp-report and Reporting API application/reports+json bodies.
+// Reports are passed on to the sink, minus duplicates and those over the rate
+// limit.
+func ReportCollector(sink ReportSink, opts ReportCollectorOptions) http.Handler {
+	if opts.MaxBody == 0 {
+		opts.MaxBody = 64 << 10
+	}
+	if opts.DedupWindow == 0 {
+		opts.DedupWindow = time.Minute
+	}
+	filter := &reportFilter{
+		window: opts.DedupWindow,
+		seen:   map[[sha256.Size]byte]time.Time{},
+		limiter: rateLimiter{
+			rate:   opts.Rate,
+			burst:  float64(max(opts.Burst, 1)),
+			tokens: float64(max(opts.Burst, 1)),
+			last:   time.Now(),
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, opts.MaxBody))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Report too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not read report", http.StatusBadRequest)
+			return
+		}
+		reps, err := parseReports(r.Header.Get("Content-Type"), data)
+		if err == errUnsupportedReport {
+			http.Error(w, "Unsupported report format", http.StatusUnsupportedMediaType)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Malformed report", http.StatusBadRequest)
+			return
+		}
+		for i := range reps {
+			if reps[i].UserAgent == "" {
+				reps[i].UserAgent = r.UserAgent()
+			}
+			if filter.allow(&reps[i]) {
+				sink.HandleReport(reps[i])
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,150 @@
+// Copyright © 2013 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package godspeed
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testLegacyReport = `{"csp-report": {
+	"document-uri": "https://example.com/page",
+	"blocked-uri": "https://evil.example.com/x.js",
+	"effective-directive": "script-src-elem"
+}}`
+
+const testReports = `[{
+	"type": "csp-violation",
+	"age": 10,
+	"url": "https://example.com/page",
+	"user_agent": "test",
+	"body": {"blockedURL": "inline", "effectiveDirective": "script-src-elem"}
+}, {
+	"type": "coep",
+	"url": "https://example.com/other",
+	"body": {"blockedURL": "https://cdn.example.com/img.png"}
+}]`
+
+func postReport(t *testing.T, h http.Handler, ctype, body string) int {
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/reports", strings.NewReader(body))
+	r.Header.Set("Content-Type", ctype)
+	h.ServeHTTP(rec, r)
+	return rec.Code
+}
+
+func TestReportCollector(t *testing.T) {
+	var got []Report
+	h := ReportCollector(ReportSinkFunc(func(rep Report) {
+		got = append(got, rep)
+	}), ReportCollectorOptions{})
+	if code := postReport(t, h, "application/csp-report", testLegacyReport); code != 204 {
+		t.Fatalf("Unexpected status code for legacy report: %d", code)
+	}
+	if code := postReport(t, h, "application/reports+json", testReports); code != 204 {
+		t.Fatalf("Unexpected status code for Reporting API reports: %d", code)
+	}
+	if len(got) != 3 {
+		t.Fatalf("Received %d reports, expected: 3", len(got))
+	}
+	if got[0].Type != "csp-violation" || got[0].URL != "https://example.com/page" ||
+		got[0].Body["blocked-uri"] != "https://evil.example.com/x.js" {
+		t.Errorf("Unexpected legacy report: %+v", got[0])
+	}
+	if got[1].Age != 10 || got[1].Body["blockedURL"] != "inline" ||
+		got[2].Type != "coep" {
+		t.Errorf("Unexpected reports: %+v", got[1:])
+	}
+	// Same again: all duplicates
+	postReport(t, h, "application/reports+json", testReports)
+	if len(got) != 3 {
+		t.Errorf("Duplicate reports passed on: %+v", got[3:])
+	}
+	// Later deliveries of the same violation, from another browser
+	again := strings.NewReplacer(`"age": 10`, `"age": 20`, `"user_agent": "test"`, `"user_agent": "other"`).Replace(testReports)
+	postReport(t, h, "application/reports+json", again)
+	if len(got) != 3 {
+		t.Errorf("Redelivered reports passed on: %+v", got[3:])
+	}
+	if code := postReport(t, h, "text/plain", testReports); code != 415 {
+		t.Errorf("Unexpected status code for unknown format: %d", code)
+	}
+	for _, c := range []struct{ ctype, body string }{
+		{"application/reports+json", "{"},
+		{"application/reports+json", "null"},
+		{"application/reports+json", `[{"url": "https://example.com/"}]`},
+		{"application/json", `{"foo": 1}`},
+		{"application/csp-report", `{"csp-report": null}`},
+	} {
+		if code := postReport(t, h, c.ctype, c.body); code != 400 {
+			t.Errorf("Unexpected status code for malformed report %s: %d", c.body, code)
+		}
+	}
+	if len(got) != 3 {
+		t.Errorf("Malformed reports passed on: %+v", got[3:])
+	}
+}
+
+func TestReportCollectorRate(t *testing.T) {
+	c := make(chan Report, 10)
+	h := ReportCollector(ChanSink(c), ReportCollectorOptions{
+		DedupWindow: -1,
+		Rate:        0.001,
+		Burst:       3,
+	})
+	for i := 0; i < 3; i++ {
+		postReport(t, h, "application/reports+json", testReports)
+	}
+	if len(c) != 3 {
+		t.Errorf("Passed on %d reports, expected: 3", len(c))
+	}
+}
+
+// Unique reports must not grow the dedup memory without bound
+func TestReportFilterBounded(t *testing.T) {
+	f := &reportFilter{
+		window:  time.Hour,
+		seen:    map[[sha256.Size]byte]time.Time{},
+		limiter: rateLimiter{rate: 0.001, burst: 1, tokens: 1, last: time.Now()},
+	}
+	for i := 0; i < 3; i++ {
+		f.allow(&Report{URL: fmt.Sprint(i)})
+	}
+	if len(f.seen) != 1 {
+		t.Errorf("Remembered %d reports, expected only the one let through", len(f.seen))
+	}
+	f.limiter.rate = 0
+	for i := 0; i < maxSeenReports+10; i++ {
+		f.allow(&Report{URL: fmt.Sprint(i)})
+	}
+	if len(f.seen) != maxSeenReports {
+		t.Errorf("Remembered %d reports, expected: %d", len(f.seen), maxSeenReports)
+	}
+	// The most recent ones are still deduplicated
+	if f.allow(&Report{URL: fmt.Sprint(maxSeenReports + 9)}) {
+		t.Errorf("Recent duplicate passed")
+	}
+}
@@ -21,26 +21,121 @@
 package godspeed
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"io"
 	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// Set the HTTP header in the response to the given value if the handler does
-// not set it to anything.
-func setDefaultHeader(h http.Handler, header, value string) http.Handler {
+// Security settings of one request, shared by all security wrappers handling
+// it. Handlers and SecurityRoutes change them through the request context.
+type securityContext struct {
+	// Header values replacing the defaults, "" meaning leave the header out.
+	// Keys are in canonical form.
+	headers map[string]string
+	// Replaces the policy of the CSP wrapper
+	csp *CSPPolicy
+	// Whether a CSP wrapper handles the request, and the nonce it uses
+	hasCSP bool
+	nonce  string
+}
+
+type securityKey struct{}
+
+func securityFrom(r *http.Request) *securityContext {
+	sc, _ := r.Context().Value(securityKey{}).(*securityContext)
+	return sc
+}
+
+// The security context of the request, created if it has none yet
+func withSecurity(r *http.Request) (*http.Request, *securityContext) {
+	if sc := securityFrom(r); sc != nil {
+		return r, sc
+	}
+	sc := &securityContext{headers: map[string]string{}}
+	return r.WithContext(context.WithValue(r.Context(), securityKey{}, sc)), sc
+}
+
+// Set the overriding header values the handler did not set itself
+func (sc *securityContext) apply(head http.Header) {
+	for header, value := range sc.headers {
+		if value != "" && head.Get(header) == "" {
+			head.Set(header, value)
+		}
+	}
+}
+
+// Generated on first use
+func (sc *securityContext) getNonce() string {
+	if sc.nonce == "" {
+		sc.nonce = newNonce()
+	}
+	return sc.nonce
+}
+
+// Replace the value of a header set by the security wrappers (XFrameOptions,
+// SecureHeaders, CSP, ...) handling this request, for this request only. An
+// empty value leaves the header out altogether. Does not affect headers the
+// handler sets itself, nor requests that no security wrapper handles.
+func SetSecurityHeader(r *http.Request, header, value string) {
+	if sc := securityFrom(r); sc != nil {
+		sc.headers[http.CanonicalHeaderKey(header)] = value
+	}
+}
+
+// SetSecurityHeader for X-Frame-Options, e.g. to allow framing of a widget
+// with an empty value.
+func SetFrameOptions(r *http.Request, value string) {
+	SetSecurityHeader(r, "X-Frame-Options", value)
+}
+
+// Replace the policy of the CSP wrapper for this request only
+func SetCSP(r *http.Request, p *CSPPolicy) {
+	if sc := securityFrom(r); sc != nil {
+		sc.csp = p
+	}
+}
+
+// Set the HTTP headers in the response to the given values, each one only if
+// the handler does not set it to anything. Overrides from the request context
+// take precedence over the defaults.
+func setDefaultHeaders(h http.Handler, defaults http.Header) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		f := func(w http.ResponseWriter) io.Writer {
+		r, sc := withSecurity(r)
+		f := func(ri ResponseInfo) io.Writer {
+			w := ri.ResponseWriter
 			head := w.Header()
-			// Only if no explicit setting exists
-			if head.Get(header) == "" {
-				head.Set(header, value)
+			for header, values := range defaults {
+				if _, ok := sc.headers[header]; ok {
+					continue
+				}
+				// Only if no explicit setting exists
+				if head.Get(header) == "" {
+					head[header] = append([]string(nil), values...)
+				}
 			}
+			sc.apply(head)
 			return w
 		}
-		h.ServeHTTP(wrapBody(w, f), r)
+		bw := WrapResponse(w, r, f)
+		h.ServeHTTP(bw, r)
+		bw.Close()
 	})
 }
 
+// Set the HTTP header in the response to the given value if the handler does
+// not set it to anything.
+func setDefaultHeader(h http.Handler, header, value string) http.Handler {
+	defaults := http.Header{}
+	defaults.Set(header, value)
+	return setDefaultHeaders(h, defaults)
+}
+
 // Disallow resources from being included in (i)frames on other sites unless
 // specified otherwise. This is done through the X-Frame-Options header. If a
 // handler does not explicitly set this header, it is set to SAMEORIGIN.
@@ -51,6 +146,392 @@ func XFrameOptions(h http.Handler) http.Handler {
 }
 
 // Turn on MSIE8 XSS protection filter.
+//
+// Deprecated: modern browsers have dropped the XSS filter, and in those that
+// had it the filter itself could be abused to leak information. SecureHeaders
+// turns it off explicitly instead.
 func XXSSProtection(h http.Handler) http.Handler {
 	return setDefaultHeader(h, "X-XSS-Protection", "1; mode=block")
 }
+
+// Stop browsers from second-guessing the Content-Type of responses, through
+// X-Content-Type-Options: nosniff.
+func XContentTypeOptions(h http.Handler) http.Handler {
+	return setDefaultHeader(h, "X-Content-Type-Options", "nosniff")
+}
+
+// Default Referrer-Policy, e.g. "strict-origin-when-cross-origin".
+//
+// https://www.w3.org/TR/referrer-policy/
+func ReferrerPolicy(h http.Handler, policy string) http.Handler {
+	return setDefaultHeader(h, "Referrer-Policy", policy)
+}
+
+// Default Permissions-Policy, e.g. "camera=(), geolocation=(self)".
+//
+// https://www.w3.org/TR/permissions-policy/
+func PermissionsPolicy(h http.Handler, policy string) http.Handler {
+	return setDefaultHeader(h, "Permissions-Policy", policy)
+}
+
+// Default Cross-Origin-Opener-Policy: "same-origin", "same-origin-allow-popups"
+// or "unsafe-none".
+func CrossOriginOpenerPolicy(h http.Handler, policy string) http.Handler {
+	return setDefaultHeader(h, "Cross-Origin-Opener-Policy", policy)
+}
+
+// Default Cross-Origin-Embedder-Policy: "require-corp", "credentialless" or
+// "unsafe-none".
+func CrossOriginEmbedderPolicy(h http.Handler, policy string) http.Handler {
+	return setDefaultHeader(h, "Cross-Origin-Embedder-Policy", policy)
+}
+
+// Default Cross-Origin-Resource-Policy: "same-origin", "same-site" or
+// "cross-origin".
+func CrossOriginResourcePolicy(h http.Handler, policy string) http.Handler {
+	return setDefaultHeader(h, "Cross-Origin-Resource-Policy", policy)
+}
+
+// Settings for Strict-Transport-Security
+type HSTS struct {
+	MaxAge            time.Duration
+	IncludeSubdomains bool
+	Preload           bool
+	// Consider requests with X-Forwarded-Proto: https secure. Only enable this
+	// behind a proxy that sets (or strips) that header.
+	TrustForwardedProto bool
+}
+
+func (o *HSTS) String() string {
+	v := "max-age=" + strconv.FormatInt(int64(o.MaxAge/time.Second), 10)
+	if o.IncludeSubdomains {
+		v += "; includeSubDomains"
+	}
+	if o.Preload {
+		v += "; preload"
+	}
+	return v
+}
+
+// Whether the request came in over TLS, as far as we know
+func (o *HSTS) secure(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return o.TrustForwardedProto &&
+		strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// Serve with or without Strict-Transport-Security, depending on how the
+// request came in. Browsers ignore the header over plain HTTP, and a
+// misconfigured proxy could otherwise make it stick for a host that does not
+// actually support HTTPS.
+func hstsHandler(o *HSTS, with, without http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if o.secure(r) {
+			with.ServeHTTP(w, r)
+		} else {
+			without.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Tell browsers to only use HTTPS for this host from now on. The header is
+// only sent on requests that came in over TLS.
+//
+// https://tools.ietf.org/html/rfc6797
+func StrictTransportSecurity(h http.Handler, opts HSTS) http.Handler {
+	with := setDefaultHeader(h, "Strict-Transport-Security", opts.String())
+	return hstsHandler(&opts, with, h)
+}
+
+// Values of security headers for SecureHeaders. Empty fields are not sent.
+type Policy struct {
+	FrameOptions              string
+	ContentTypeOptions        string
+	XSSProtection             string
+	ReferrerPolicy            string
+	PermissionsPolicy         string
+	CrossOriginOpenerPolicy   string
+	CrossOriginEmbedderPolicy string
+	CrossOriginResourcePolicy string
+	// Nil means no Strict-Transport-Security
+	HSTS *HSTS
+}
+
+// Safe for practically any site. The cross-origin and permissions policies
+// depend too much on what a site does to have a default, and HSTS can not be
+// undone easily, so those are left for the application to decide.
+var DefaultPolicy = Policy{
+	FrameOptions:       "SAMEORIGIN",
+	ContentTypeOptions: "nosniff",
+	// Turn the XSS filter off where it still exists
+	XSSProtection:  "0",
+	ReferrerPolicy: "strict-origin-when-cross-origin",
+}
+
+func (p *Policy) headers() http.Header {
+	head := http.Header{}
+	for header, value := range map[string]string{
+		"X-Frame-Options":              p.FrameOptions,
+		"X-Content-Type-Options":       p.ContentTypeOptions,
+		"X-XSS-Protection":             p.XSSProtection,
+		"Referrer-Policy":              p.ReferrerPolicy,
+		"Permissions-Policy":           p.PermissionsPolicy,
+		"Cross-Origin-Opener-Policy":   p.CrossOriginOpenerPolicy,
+		"Cross-Origin-Embedder-Policy": p.CrossOriginEmbedderPolicy,
+		"Cross-Origin-Resource-Policy": p.CrossOriginResourcePolicy,
+	} {
+		if value != "" {
+			head.Set(header, value)
+		}
+	}
+	return head
+}
+
+// Set all headers of the policy, unless the handler sets them itself. All of
+// them are set in one go, which is cheaper than nesting the individual
+// wrappers.
+func SecureHeaders(h http.Handler, p Policy) http.Handler {
+	head := p.headers()
+	without := setDefaultHeaders(h, head)
+	if p.HSTS == nil {
+		return without
+	}
+	head = head.Clone()
+	head.Set("Strict-Transport-Security", p.HSTS.String())
+	return hstsHandler(p.HSTS, setDefaultHeaders(h, head), without)
+}
+
+// SecureHeaders with DefaultPolicy
+func SecureDefaults(h http.Handler) http.Handler {
+	return SecureHeaders(h, DefaultPolicy)
+}
+
+// Content-Security-Policy directive names
+type CSPDirective string
+
+const (
+	DefaultSrc              CSPDirective = "default-src"
+	ScriptSrc               CSPDirective = "script-src"
+	StyleSrc                CSPDirective = "style-src"
+	ImgSrc                  CSPDirective = "img-src"
+	ConnectSrc              CSPDirective = "connect-src"
+	FontSrc                 CSPDirective = "font-src"
+	ObjectSrc               CSPDirective = "object-src"
+	MediaSrc                CSPDirective = "media-src"
+	FrameSrc                CSPDirective = "frame-src"
+	WorkerSrc               CSPDirective = "worker-src"
+	ManifestSrc             CSPDirective = "manifest-src"
+	FrameAncestors          CSPDirective = "frame-ancestors"
+	BaseURI                 CSPDirective = "base-uri"
+	FormAction              CSPDirective = "form-action"
+	UpgradeInsecureRequests CSPDirective = "upgrade-insecure-requests"
+)
+
+// Content-Security-Policy source expressions. Hosts and schemes like
+// "https://cdn.example.com" or "data:" can be used as they are.
+type CSPSource string
+
+const (
+	SourceSelf          CSPSource = "'self'"
+	SourceNone          CSPSource = "'none'"
+	SourceUnsafeInline  CSPSource = "'unsafe-inline'"
+	SourceUnsafeEval    CSPSource = "'unsafe-eval'"
+	SourceStrictDynamic CSPSource = "'strict-dynamic'"
+	// Replaced by 'nonce-...' with the nonce of the request, see CSPNonce
+	SourceNonce CSPSource = "'nonce'"
+)
+
+type cspDirective struct {
+	name    CSPDirective
+	sources []CSPSource
+}
+
+// A Content-Security-Policy, built with NewCSP and its methods:
+//
+//	NewCSP().
+//		Add(DefaultSrc, SourceSelf).
+//		Add(ScriptSrc, SourceSelf, SourceNonce).
+//		ReportTo("csp")
+//
+// https://www.w3.org/TR/CSP3/
+type CSPPolicy struct {
+	directives []cspDirective
+	// Send as Content-Security-Policy-Report-Only: report violations, but
+	// do not block anything
+	ReportOnly bool
+}
+
+func NewCSP() *CSPPolicy {
+	return &CSPPolicy{}
+}
+
+// Add sources to a directive. Returns the policy itself, for chaining.
+func (p *CSPPolicy) Add(d CSPDirective, sources ...CSPSource) *CSPPolicy {
+	for i := range p.directives {
+		if p.directives[i].name == d {
+			p.directives[i].sources = append(p.directives[i].sources, sources...)
+			return p
+		}
+	}
+	p.directives = append(p.directives, cspDirective{d, sources})
+	return p
+}
+
+// Where browsers POST violation reports, the old way
+func (p *CSPPolicy) ReportURI(uri string) *CSPPolicy {
+	return p.Add("report-uri", CSPSource(uri))
+}
+
+// Reporting API endpoint group to send violation reports to
+func (p *CSPPolicy) ReportTo(group string) *CSPPolicy {
+	return p.Add("report-to", CSPSource(group))
+}
+
+func (p *CSPPolicy) usesNonce() bool {
+	for _, d := range p.directives {
+		for _, src := range d.sources {
+			if src == SourceNonce {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Header value, with the nonce filled in
+func (p *CSPPolicy) value(nonce string) string {
+	var b strings.Builder
+	for i, d := range p.directives {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(string(d.name))
+		for _, src := range d.sources {
+			b.WriteByte(' ')
+			if src == SourceNonce {
+				b.WriteString("'nonce-" + nonce + "'")
+			} else {
+				b.WriteString(string(src))
+			}
+		}
+	}
+	return b.String()
+}
+
+// Header value, with the nonce placeholder left in
+func (p *CSPPolicy) String() string {
+	return p.value("{nonce}")
+}
+
+func (p *CSPPolicy) header() string {
+	if p.ReportOnly {
+		return "Content-Security-Policy-Report-Only"
+	}
+	return "Content-Security-Policy"
+}
+
+// The CSP nonce of this request, for <script nonce="..."> in templates. Only
+// put it on tags the application writes itself: a nonce on anything derived
+// from user input defeats the policy. Empty if the request is not handled by a
+// CSP wrapper.
+func CSPNonce(r *http.Request) string {
+	sc := securityFrom(r)
+	if sc == nil || !sc.hasCSP {
+		return ""
+	}
+	return sc.getNonce()
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("godspeed: no randomness for CSP nonce: " + err.Error())
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// Set the Content-Security-Policy header (or the Report-Only variant), unless
+// the handler sets it itself. Every request gets a fresh nonce for the
+// SourceNonce placeholder, available to the handler through CSPNonce. The
+// policy can be replaced per request with SetCSP or SecurityRoutes.
+func CSP(h http.Handler, p *CSPPolicy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, sc := withSecurity(r)
+		sc.hasCSP = true
+		f := func(ri ResponseInfo) io.Writer {
+			p := p
+			if sc.csp != nil {
+				p = sc.csp
+			}
+			w := ri.ResponseWriter
+			head := w.Header()
+			header := p.header()
+			if _, ok := sc.headers[header]; !ok && head.Get(header) == "" {
+				var nonce string
+				if p.usesNonce() {
+					nonce = sc.getNonce()
+				}
+				head.Set(header, p.value(nonce))
+			}
+			sc.apply(head)
+			return w
+		}
+		bw := WrapResponse(w, r, f)
+		h.ServeHTTP(bw, r)
+		bw.Close()
+	})
+}
+
+// Security settings for requests matching a path pattern
+type SecurityRoute struct {
+	// As in path.Match, or a prefix followed by "/*" to match everything
+	// below it
+	Pattern string
+	// Header values replacing the defaults, as with SetSecurityHeader
+	Headers map[string]string
+	// Replaces the policy of the CSP wrapper, if not nil. Does nothing
+	// without a CSP wrapper inside SecurityRoutes.
+	CSP *CSPPolicy
+}
+
+func matchPath(pattern, p string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return p == prefix || strings.HasPrefix(p, prefix+"/")
+	}
+	ok, _ := path.Match(pattern, p)
+	return ok
+}
+
+// Select security settings by request path: the first route matching the path
+// overrides the defaults of the security wrappers inside this one, e.g.:
+//
+//	site := NewCSP().Add(FrameAncestors, SourceSelf)
+//	SecurityRoutes(CSP(SecureDefaults(h), site), SecurityRoute{
+//		Pattern: "/embed/*",
+//		Headers: map[string]string{"X-Frame-Options": ""},
+//		CSP:     NewCSP().Add(FrameAncestors, "https://partner.example.com"),
+//	})
+//
+// Handlers can still override the route with SetSecurityHeader and friends.
+func SecurityRoutes(h http.Handler, routes ...SecurityRoute) http.Handler {
+	// Overrides for headers no inner wrapper knows about
+	h = setDefaultHeaders(h, nil)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, sc := withSecurity(r)
+		for _, route := range routes {
+			if !matchPath(route.Pattern, r.URL.Path) {
+				continue
+			}
+			for header, value := range route.Headers {
+				sc.headers[http.CanonicalHeaderKey(header)] = value
+			}
+			if route.CSP != nil {
+				sc.csp = route.CSP
+			}
+			break
+		}
+		h.ServeHTTP(w, r)
+	})
+}
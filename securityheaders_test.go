@@ -21,10 +21,12 @@
 package godspeed
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 var testHandlerXFrameOptions = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -55,3 +57,155 @@ func TestXFrameOptionsExplicit(t *testing.T) {
 			opt)
 	}
 }
+
+// Default headers must also make it onto responses without a body
+func TestXFrameOptionsNoBody(t *testing.T) {
+	for _, h := range []http.Handler{
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}),
+		http.RedirectHandler("/elsewhere", http.StatusFound),
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	} {
+		rec := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/test.txt", nil)
+		XFrameOptions(h).ServeHTTP(rec, r)
+		// Headers as sent, not as they are now
+		if opt := rec.Result().Header.Get("X-Frame-Options"); opt != "SAMEORIGIN" {
+			t.Errorf("Unexpected X-Frame-Options value on %d response: %q, expected: SAMEORIGIN",
+				rec.Code, opt)
+		}
+	}
+}
+
+func TestSecureHeaders(t *testing.T) {
+	p := DefaultPolicy
+	p.CrossOriginOpenerPolicy = "same-origin"
+	p.HSTS = &HSTS{MaxAge: 24 * time.Hour, IncludeSubdomains: true}
+	h := SecureHeaders(testHandlerXFrameOptions, p)
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/test.txt", nil)
+	h.ServeHTTP(rec, r)
+	assert200(t, r, rec)
+	for header, expected := range map[string]string{
+		// Set by the handler
+		"X-Frame-Options":            "DENY",
+		"X-Content-Type-Options":     "nosniff",
+		"X-Xss-Protection":           "0",
+		"Referrer-Policy":            "strict-origin-when-cross-origin",
+		"Cross-Origin-Opener-Policy": "same-origin",
+		// Not over plain HTTP
+		"Strict-Transport-Security":    "",
+		"Cross-Origin-Embedder-Policy": "",
+	} {
+		if v := rec.Header().Get(header); v != expected {
+			t.Errorf("Unexpected %s value: %q, expected: %q", header, v, expected)
+		}
+	}
+}
+
+func TestStrictTransportSecurity(t *testing.T) {
+	for _, c := range []struct {
+		tls, forwarded, trust bool
+		expected              string
+	}{
+		{false, false, false, ""},
+		{true, false, false, "max-age=3600; preload"},
+		{false, true, false, ""},
+		{false, true, true, "max-age=3600; preload"},
+	} {
+		opts := HSTS{MaxAge: time.Hour, Preload: true, TrustForwardedProto: c.trust}
+		rec := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/test.txt", nil)
+		if c.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		if c.forwarded {
+			r.Header.Set("X-Forwarded-Proto", "https")
+		}
+		StrictTransportSecurity(testHandlerSimple, opts).ServeHTTP(rec, r)
+		assert200(t, r, rec)
+		if v := rec.Header().Get("Strict-Transport-Security"); v != c.expected {
+			t.Errorf("Unexpected Strict-Transport-Security value for %+v: %q",
+				c, v)
+		}
+	}
+}
+
+func TestCSP(t *testing.T) {
+	var nonce string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce = CSPNonce(r)
+		fmt.Fprint(w, "test")
+	})
+	p := NewCSP().
+		Add(DefaultSrc, SourceSelf).
+		Add(ScriptSrc, SourceSelf, SourceNonce).
+		Add(ImgSrc, "data:").
+		ReportURI("/csp-reports")
+	p.ReportOnly = true
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/test.txt", nil)
+	CSP(h, p).ServeHTTP(rec, r)
+	assert200(t, r, rec)
+	if len(nonce) < 16 {
+		t.Fatalf("No proper nonce in request context: %q", nonce)
+	}
+	expected := "default-src 'self'; script-src 'self' 'nonce-" + nonce +
+		"'; img-src data:; report-uri /csp-reports"
+	if v := rec.Header().Get("Content-Security-Policy-Report-Only"); v != expected {
+		t.Errorf("Unexpected CSP: %q, expected: %q", v, expected)
+	}
+	// Fresh nonce every time
+	first := nonce
+	CSP(h, p).ServeHTTP(httptest.NewRecorder(), r)
+	if nonce == first {
+		t.Errorf("Nonce reused: %q", nonce)
+	}
+}
+
+func TestSecurityRoutes(t *testing.T) {
+	embedCSP := NewCSP().Add(FrameAncestors, "https://partner.example.com")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/embed/special" {
+			SetFrameOptions(r, "DENY")
+		}
+		fmt.Fprint(w, "test")
+	})
+	site := NewCSP().Add(FrameAncestors, SourceSelf)
+	stack := SecurityRoutes(CSP(SecureDefaults(h), site), SecurityRoute{
+		Pattern: "/embed/*",
+		Headers: map[string]string{
+			"x-frame-options":    "",
+			"Permissions-Policy": "fullscreen=*",
+		},
+		CSP: embedCSP,
+	})
+	for _, c := range []struct {
+		path, frameOptions, csp, permissions string
+	}{
+		{"/index.html", "SAMEORIGIN", "frame-ancestors 'self'", ""},
+		{"/embed/widget", "", "frame-ancestors https://partner.example.com", "fullscreen=*"},
+		{"/embed/special", "DENY", "frame-ancestors https://partner.example.com", "fullscreen=*"},
+		{"/embedded", "SAMEORIGIN", "frame-ancestors 'self'", ""},
+	} {
+		rec := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", c.path, nil)
+		stack.ServeHTTP(rec, r)
+		assert200(t, r, rec)
+		head := rec.Result().Header
+		if v := head.Get("X-Frame-Options"); v != c.frameOptions {
+			t.Errorf("%s: unexpected X-Frame-Options %q, expected: %q", c.path, v, c.frameOptions)
+		}
+		if v := head.Get("Content-Security-Policy"); v != c.csp {
+			t.Errorf("%s: unexpected CSP %q, expected: %q", c.path, v, c.csp)
+		}
+		if v := head.Get("Permissions-Policy"); v != c.permissions {
+			t.Errorf("%s: unexpected Permissions-Policy %q, expected: %q", c.path, v, c.permissions)
+		}
+		// Defaults not overridden stay
+		if v := head.Get("X-Content-Type-Options"); v != "nosniff" {
+			t.Errorf("%s: unexpected X-Content-Type-Options %q", c.path, v)
+		}
+	}
+}
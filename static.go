@@ -0,0 +1,119 @@
+// Copyright © 2013 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package godspeed
+
+import (
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Content codings of precompressed files, in order of preference
+var precompressedCodings = []string{"br", "zstd", "gzip"}
+
+// File name extension of precompressed files by content coding
+var precompressedExts = map[string]string{
+	"br":   ".br",
+	"zstd": ".zst",
+	"gzip": ".gz",
+}
+
+func without(list []string, s string) []string {
+	res := make([]string, 0, len(list))
+	for _, x := range list {
+		if x != s {
+			res = append(res, x)
+		}
+	}
+	return res
+}
+
+// Open the precompressed sibling of the file at upath that suits the client
+// best, if any. Returns its content coding as well, or nil and "".
+func openPrecompressed(r *http.Request, root http.FileSystem, upath string) (http.File, fs.FileInfo, string) {
+	accept := r.Header.Get("Accept-Encoding")
+	for codings := precompressedCodings; ; {
+		c := negotiateEncoding(accept, codings)
+		if c == "" {
+			return nil, nil, ""
+		}
+		codings = without(codings, c)
+		f, err := root.Open(upath + precompressedExts[c])
+		if err != nil {
+			continue
+		}
+		stat, err := f.Stat()
+		if err != nil || stat.IsDir() {
+			f.Close()
+			continue
+		}
+		return f, stat, c
+	}
+}
+
+// Headers for a precompressed sibling: the type of the original file, "" if
+// unknown, and the coding of the sibling
+func setPrecompressedHeaders(head http.Header, ctype, coding string) {
+	if ctype == "" {
+		// Sniffing the compressed data would be pointless
+		ctype = "application/octet-stream"
+	}
+	head.Set("Content-Type", ctype)
+	head.Set("Content-Encoding", coding)
+	addVary(head, "Accept-Encoding")
+}
+
+// Serve the precompressed sibling of the requested file that suits the client
+// best, if any. Returns false if nothing was served.
+func servePrecompressed(w http.ResponseWriter, r *http.Request, root http.FileSystem) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if strings.HasSuffix(r.URL.Path, "/") {
+		// Directory
+		return false
+	}
+	upath := path.Clean("/" + r.URL.Path)
+	f, stat, c := openPrecompressed(r, root, upath)
+	if f == nil {
+		return false
+	}
+	defer f.Close()
+	setPrecompressedHeaders(w.Header(), DefaultMimeRegistry.TypeByPath(upath), c)
+	http.ServeContent(w, r, upath, stat.ModTime(), f)
+	return true
+}
+
+// Serve files like http.FileServer, preferring precompressed siblings of the
+// requested file: for /app.js that is /app.js.br, /app.js.zst or /app.js.gz,
+// whichever exists and is accepted (and preferred) by the client. It is served
+// with the Content-Type of the original name and the matching
+// Content-Encoding. Without a suitable sibling the file itself is served,
+// compressed on the fly if possible.
+func PrecompressedFileServer(root http.FileSystem) http.Handler {
+	fallback := Compress(http.FileServer(root))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !servePrecompressed(w, r, root) {
+			fallback.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,80 @@
+// Copyright © 2013 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package godspeed
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+)
+
+var testFS = http.FS(fstest.MapFS{
+	"app.js":    {Data: []byte("identity")},
+	"app.js.gz": {Data: []byte("gzipped")},
+	"app.js.br": {Data: []byte("brotli")},
+	"style.css": {Data: []byte("body {}")},
+})
+
+func testPrecompressed(t *testing.T, accept, encoding, body string) {
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/app.js", nil)
+	if accept != "" {
+		r.Header.Set("Accept-Encoding", accept)
+	}
+	PrecompressedFileServer(testFS).ServeHTTP(rec, r)
+	assert200(t, r, rec)
+	if enc := rec.Header().Get("Content-Encoding"); enc != encoding {
+		t.Errorf("Accept-Encoding %q: served encoding %q, expected: %q",
+			accept, enc, encoding)
+	}
+	if b := rec.Body.String(); b != body {
+		t.Errorf("Accept-Encoding %q: served %q, expected: %q", accept, b, body)
+	}
+	testContentType(t, r, rec, "text/javascript; charset=utf-8")
+	if vary := rec.Header().Get("Vary"); vary != "Accept-Encoding" {
+		t.Errorf("Accept-Encoding %q: unexpected Vary %q", accept, vary)
+	}
+}
+
+func TestPrecompressed(t *testing.T) {
+	testPrecompressed(t, "gzip, deflate, br", "br", "brotli")
+	testPrecompressed(t, "gzip, br;q=0.5", "gzip", "gzipped")
+	testPrecompressed(t, "br;q=0, *", "gzip", "gzipped")
+	// No zstd sibling: fall back to the next best
+	testPrecompressed(t, "zstd, gzip;q=0.1", "gzip", "gzipped")
+	testPrecompressed(t, "", "", "identity")
+}
+
+// Files without siblings are compressed on the fly
+func TestPrecompressedFallback(t *testing.T) {
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/style.css", nil)
+	r.Header.Set("Accept-Encoding", "br, gzip")
+	PrecompressedFileServer(testFS).ServeHTTP(rec, r)
+	assert200(t, r, rec)
+	if enc := rec.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Errorf("Unexpected Content-Encoding: %q, expected: gzip", enc)
+	}
+	if body := decode(t, rec); body != "body {}" {
+		t.Errorf("Unexpected response decompressed: %q, expected: 'body {}'", body)
+	}
+}